@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/mattermost/platform/model"
+)
+
+var accessMutex sync.Mutex
+
+// refusedChannels holds the ids of the channels the server refused adds to
+var refusedChannels = map[string]bool{}
+
+// CanAddMembers reports whether the bot can add users to the channel. A
+// channel is taken to be out of reach once the server has refused an add
+// to it with 403 Forbidden, and is then skipped for every user until
+// !refreshchannels.
+func CanAddMembers(channel *model.Channel) bool {
+	accessMutex.Lock()
+	defer accessMutex.Unlock()
+
+	return !refusedChannels[channel.Id]
+}
+
+// RecordAddRefused notes that the server refused an add to the channel. A
+// 403 marks the channel out of reach, logged once; other failures may
+// well be the user's and change nothing.
+func RecordAddRefused(channel *model.Channel, team_name string, err *model.AppError) {
+	if err.StatusCode != http.StatusForbidden {
+		return
+	}
+
+	accessMutex.Lock()
+	known := refusedChannels[channel.Id]
+	refusedChannels[channel.Id] = true
+	accessMutex.Unlock()
+
+	if !known {
+		logger.Warn("The bot can't add members to the channel, skipping it for autoadd until !refreshchannels",
+			"channel", channel.Name, "team", team_name)
+	}
+}
+
+// ResetChannelAccess forgets which channels the bot can't add members to
+func ResetChannelAccess() {
+	accessMutex.Lock()
+	refusedChannels = map[string]bool{}
+	accessMutex.Unlock()
+}
+
+func HandleRefreshChannelsCommand(post *model.Post, args []string) {
+	ResetChannelAccess()
+
+	ReplyToPost(post, "Forgot which channels the bot can't add members to, they will be tried again.")
+}
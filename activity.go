@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	LAST_ADD_CHECK_INTERVAL = time.Minute
+)
+
+var activityMutex sync.Mutex
+var startedAt = time.Now()
+var lastSuccessfulAdd time.Time
+var lastAddAlerted bool
+
+// lastAddCountedFrom is when counting toward the next add started: startup,
+// or the last !reset
+var lastAddCountedFrom = startedAt
+
+var eventCounts = map[string]int{}
+var eventCountsSinceReset = map[string]int{}
+var eventCountsResetAt = time.Now()
+
+// RecordSuccessfulAdd notes that a user was just added by autoadd
+func RecordSuccessfulAdd() {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+
+	lastSuccessfulAdd = time.Now()
+	lastAddAlerted = false
+	metricLastSuccessfulAdd.SetToCurrentTime()
+
+	CountAdd()
+}
+
+// TimeSinceLastAdd returns how long ago the last successful add happened
+// and false if there has not been one since startup or the last reset, in
+// which case the time since then is returned instead.
+func TimeSinceLastAdd() (time.Duration, bool) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+
+	if lastSuccessfulAdd.IsZero() {
+		return time.Since(lastAddCountedFrom), false
+	}
+
+	return time.Since(lastSuccessfulAdd), true
+}
+
+// ResetLastAdd forgets the last successful add, so the time since it is
+// counted from now
+func ResetLastAdd() {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+
+	lastSuccessfulAdd = time.Time{}
+	lastAddAlerted = false
+	lastAddCountedFrom = time.Now()
+}
+
+func HandleLastAddCommand(post *model.Post, args []string) {
+	since, ok := TimeSinceLastAdd()
+	if !ok {
+		ReplyToPost(post, "No user has been added since startup or the last reset, "+since.Round(time.Second).String()+" ago.")
+		return
+	}
+
+	ReplyToPost(post, "The last successful add was "+since.Round(time.Second).String()+" ago.")
+}
+
+// WatchLastAdd logs an alert once whenever the time since the last
+// successful add exceeds params.LastAddAlertAfter.
+func WatchLastAdd() {
+	if Config().LastAddAlertAfter <= 0 {
+		return
+	}
+
+	StartTask("lastadd-watch", func() {
+		for range time.Tick(LAST_ADD_CHECK_INTERVAL) {
+			TaskActivity("lastadd-watch")
+
+			since, _ := TimeSinceLastAdd()
+			if since < Config().LastAddAlertAfter {
+				continue
+			}
+
+			activityMutex.Lock()
+			alerted := lastAddAlerted
+			lastAddAlerted = true
+			activityMutex.Unlock()
+
+			if !alerted {
+				logger.Error("!!! No user has been added for a while !!!", "since", since.Round(time.Second))
+			}
+		}
+	})
+}
+
+// CountEvent records that a websocket event of the given type was handled
+func CountEvent(event_type string) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+
+	eventCounts[event_type]++
+	eventCountsSinceReset[event_type]++
+}
+
+// ClearEventCounts forgets every event counted so far
+func ClearEventCounts() {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+
+	eventCounts = map[string]int{}
+	eventCountsSinceReset = map[string]int{}
+	eventCountsResetAt = time.Now()
+}
+
+// ResetEventCounts clears the counts shown as "since reset"
+func ResetEventCounts() {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+
+	eventCountsSinceReset = map[string]int{}
+	eventCountsResetAt = time.Now()
+}
+
+// HandleEventStatsCommand shows how many events of each type were handled.
+// Usage: !eventstats [reset]
+func HandleEventStatsCommand(post *model.Post, args []string) {
+	if len(args) > 0 && args[0] == "reset" {
+		if !IsAdmin(post.UserId) {
+			ReplyToPost(post, "Sorry, only bot admins can use `reset`.")
+			return
+		}
+		ResetEventCounts()
+		ReplyToPost(post, "Event counts reset.")
+		return
+	}
+
+	activityMutex.Lock()
+	types := make([]string, 0, len(eventCounts))
+	for event_type := range eventCounts {
+		types = append(types, event_type)
+	}
+	sort.Strings(types)
+
+	msg := fmt.Sprintf("| Event | Since startup | Since reset (%s ago) |\n|---|---|---|\n", time.Since(eventCountsResetAt).Round(time.Second))
+	for _, event_type := range types {
+		msg += fmt.Sprintf("| %s | %d | %d |\n", event_type, eventCounts[event_type], eventCountsSinceReset[event_type])
+	}
+	activityMutex.Unlock()
+
+	if len(types) == 0 {
+		ReplyToPost(post, "No events received yet.")
+		return
+	}
+
+	ReplyToPost(post, msg)
+}
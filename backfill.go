@@ -0,0 +1,207 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	BACKFILL_PAGE_SIZE      = 200
+	BACKFILL_PROGRESS_EVERY = 100
+)
+
+var backfillsMutex sync.Mutex
+var backfills = map[string]context.CancelFunc{}
+
+// startBackfill returns a context for a bulk operation that ends when the
+// timeout runs out or the operation is cancelled with !cancel. Call the
+// returned function once the operation is over.
+func startBackfill(name string, timeout time.Duration) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(shutdownCtx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(shutdownCtx)
+	}
+
+	backfillsMutex.Lock()
+	backfills[name] = cancel
+	backfillsMutex.Unlock()
+
+	return ctx, func() {
+		backfillsMutex.Lock()
+		delete(backfills, name)
+		backfillsMutex.Unlock()
+		cancel()
+	}
+}
+
+// backfillOutcome describes how a bulk operation ended
+func backfillOutcome(ctx context.Context) string {
+	switch ctx.Err() {
+	case context.Canceled:
+		return "Cancelled"
+	case context.DeadlineExceeded:
+		return "Timed out"
+	}
+
+	return "Finished"
+}
+
+// HandleSyncTeamCommand runs every member of a team through autoadd,
+// stopping early on the optional timeout or !cancel.
+// Usage: !syncteam <team> confirm [timeout]
+func HandleSyncTeamCommand(post *model.Post, args []string) {
+	if len(args) == 0 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"syncteam <team> confirm [timeout]`")
+		return
+	}
+
+	team_name := args[0]
+	team, resp := client.GetTeamByName(team_name, "")
+	if resp.Error != nil {
+		ReplyToPost(post, "Could not find team `"+team_name+"`.")
+		PrintError("Could not find team", resp.Error, "team", team_name)
+		return
+	}
+
+	if len(args) < 2 || args[1] != "confirm" {
+		ReplyToPost(post, "This will run **every member** of `"+team_name+"` through autoadd. "+
+			"Run `"+CommandPrefix()+"syncteam "+team_name+" confirm` to proceed.")
+		return
+	}
+
+	var timeout time.Duration
+	if len(args) > 2 {
+		var err error
+		if timeout, err = time.ParseDuration(args[2]); err != nil {
+			ReplyToPost(post, "`"+args[2]+"` is not a valid timeout, try something like `30m`.")
+			return
+		}
+	}
+
+	task_name := "syncteam-" + team_name
+	ctx, done := startBackfill(task_name, timeout)
+	StartTask(task_name, func() {
+		defer done()
+
+		ReplyToPost(post, "Starting sync of team `"+team_name+"`, `"+CommandPrefix()+"cancel "+task_name+"` stops it.")
+
+		start := time.Now()
+		processed := 0
+	pages:
+		for page := 0; ctx.Err() == nil; page++ {
+			users, resp := client.GetUsersInTeam(team.Id, page, BACKFILL_PAGE_SIZE, "")
+			if resp.Error != nil {
+				ReplyToPost(post, fmt.Sprintf("Sync of `%s` stopped after %d members: could not list page %d.", team_name, processed, page))
+				PrintError("Sync stopped, could not list members", resp.Error, "team", team_name, "page", page)
+				return
+			}
+			if len(users) == 0 {
+				break
+			}
+
+			for _, user := range users {
+				if ctx.Err() != nil {
+					break pages
+				}
+
+				HandleNewUserOrExistingUserAdding(user.Id)
+				TaskActivity(task_name)
+
+				processed++
+				if processed%BACKFILL_PROGRESS_EVERY == 0 {
+					ReplyToPost(post, fmt.Sprintf("Synced %d members of `%s` so far.", processed, team_name))
+				}
+			}
+		}
+
+		ReplyToPost(post, fmt.Sprintf("%s syncing `%s`: %d members processed in %s.",
+			backfillOutcome(ctx), team_name, processed, time.Since(start).Round(time.Second)))
+	})
+}
+
+// BackfillOnStart runs the current members of the monitored channels
+// through autoadd once, in the background, when params.BackfillOnStart is
+// set. Users processed within the cooldown are skipped as usual, and
+// "!cancel startup-backfill" stops it.
+func BackfillOnStart() {
+	if !Config().BackfillOnStart || !IsLeader() {
+		return
+	}
+
+	task_name := "startup-backfill"
+	ctx, done := startBackfill(task_name, 0)
+	StartTask(task_name, func() {
+		defer done()
+
+		start := time.Now()
+		seen := map[string]bool{}
+		processed, added := 0, 0
+	channels:
+		for _, channel := range monitoredChannels {
+			for page := 0; ctx.Err() == nil; page++ {
+				members, resp := client.GetChannelMembers(channel.Id, page, BACKFILL_PAGE_SIZE, "")
+				if resp.Error != nil {
+					PrintError("Backfill could not list members", resp.Error, "channel", channel.Name, "page", page)
+					continue channels
+				}
+				if members == nil || len(*members) == 0 {
+					break
+				}
+
+				for _, member := range *members {
+					if ctx.Err() != nil {
+						break channels
+					}
+					if seen[member.UserId] {
+						continue
+					}
+					seen[member.UserId] = true
+
+					if len(HandleNewUserOrExistingUserAdding(member.UserId)) > 0 {
+						added++
+					}
+					TaskActivity(task_name)
+					processed++
+				}
+			}
+		}
+
+		logger.Info(backfillOutcome(ctx)+" backfilling the monitored channels", "members", processed,
+			"added", added, "channels", len(monitoredChannels), "duration", time.Since(start).Round(time.Second))
+	})
+}
+
+// HandleCancelCommand stops the named bulk operation, or all of them.
+// Usage: !cancel [name]
+func HandleCancelCommand(post *model.Post, args []string) {
+	backfillsMutex.Lock()
+	defer backfillsMutex.Unlock()
+
+	var cancelled []string
+	for name, cancel := range backfills {
+		if len(args) == 0 || args[0] == name {
+			cancel()
+			cancelled = append(cancelled, name)
+		}
+	}
+
+	if len(cancelled) == 0 {
+		ReplyToPost(post, "Nothing to cancel.")
+		return
+	}
+
+	sort.Strings(cancelled)
+	ReplyToPost(post, "Cancelling "+strings.Join(cancelled, ", ")+", they stop after the user in progress.")
+}
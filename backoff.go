@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// Jitter strategies for params.RetryJitter, see
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+const (
+	JITTER_NONE  = "none"
+	JITTER_FULL  = "full"
+	JITTER_EQUAL = "equal"
+
+	DEFAULT_MAX_RETRIES = 3
+	RETRY_BASE_DELAY    = 500 * time.Millisecond
+	RETRY_MAX_DELAY     = 10 * time.Second
+)
+
+// BackoffDelay returns how long to wait before retry number attempt
+// (starting at 0): base doubled for every attempt, capped at max, with
+// params.RetryJitter applied so that retries failing together do not all
+// come back at the same moment.
+func BackoffDelay(base time.Duration, max time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	switch Config().RetryJitter {
+	case JITTER_FULL:
+		return time.Duration(rand.Int63n(int64(delay) + 1))
+	case JITTER_EQUAL:
+		return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	return delay
+}
+
+// MaxRetries is how many times a failing API call is attempted,
+// params.MaxRetries or DEFAULT_MAX_RETRIES.
+func MaxRetries() int {
+	if Config().MaxRetries <= 0 {
+		return DEFAULT_MAX_RETRIES
+	}
+
+	return Config().MaxRetries
+}
+
+// retryWithBackoff calls fn up to attempts times until it succeeds. Only
+// server and network errors are retried, a 4xx answer will not change by
+// asking again.
+func retryWithBackoff(attempts int, fn func() *model.AppError) *model.AppError {
+	var err *model.AppError
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(BackoffDelay(RETRY_BASE_DELAY, RETRY_MAX_DELAY, attempt-1))
+		}
+
+		err = fn()
+		if err == nil || !isTransientError(err) {
+			return err
+		}
+
+		logger.Warn("API call failed, retrying", "attempt", attempt+1, "of", attempts, "error", err.Message)
+	}
+
+	return err
+}
+
+// isTransientError reports whether err came from a 5xx answer or from not
+// getting an answer at all.
+func isTransientError(err *model.AppError) bool {
+	return err.StatusCode == 0 || err.StatusCode >= 500
+}
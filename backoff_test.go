@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		failures int
+		retries  int
+		ok       bool
+		calls    int
+	}{
+		{"fails twice then succeeds", http.StatusServiceUnavailable, 2, 0, true, 3},
+		{"client errors are not retried", http.StatusForbidden, 2, 0, false, 1},
+		{"gives up after maxretries", http.StatusBadGateway, 2, 2, false, 2},
+	}
+
+	for _, test := range tests {
+		fake := setupAutoadd(t)
+		p := *Config()
+		p.MaxRetries = test.retries
+		withConfig(t, &p)
+		fake.failTimes("AddTeamMember team-eng jane", test.status, test.failures)
+
+		team := fake.teams["team-eng"]
+		if _, ok := AddUserToTeam("jane", team.Id, "eng", nil, team); ok != test.ok {
+			t.Errorf("%s: the add returned %v, expected %v", test.name, ok, test.ok)
+		}
+		if calls := fake.called("AddTeamMember"); len(calls) != test.calls {
+			t.Errorf("%s: made %q, expected %d attempts", test.name, calls, test.calls)
+		}
+		if fake.teamMembers[team.Id]["jane"] != test.ok {
+			t.Errorf("%s: jane's membership is %v, expected %v", test.name, !test.ok, test.ok)
+		}
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	for status, transient := range map[int]bool{
+		0:                              true,
+		http.StatusInternalServerError: true,
+		http.StatusGatewayTimeout:      true,
+		http.StatusBadRequest:          false,
+		http.StatusNotFound:            false,
+		http.StatusTooManyRequests:     false,
+	} {
+		if isTransientError(failed("test", status).Error) != transient {
+			t.Errorf("status %d: expected transient to be %v", status, transient)
+		}
+	}
+}
+
+func TestValidateRetryJitter(t *testing.T) {
+	for _, jitter := range []string{"", JITTER_NONE, JITTER_FULL, JITTER_EQUAL} {
+		if err := ValidateConfiguration(&Params{RetryJitter: jitter}); err != nil {
+			t.Errorf("%q was refused: %v", jitter, err)
+		}
+	}
+
+	if err := ValidateConfiguration(&Params{RetryJitter: "Full"}); err == nil {
+		t.Error("an unknown retryjitter was accepted")
+	}
+}
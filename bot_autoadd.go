@@ -4,45 +4,131 @@
 package main
 
 import (
-	//"fmt"
+	"fmt"
+	"errors"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"syscall"
 	"strings"
 	"io/ioutil"
 	//regexp"
 	"gopkg.in/yaml.v2"
 	"github.com/mattermost/platform/model"
 	"time"
-	"strconv"
+	"sync"
+	"sync/atomic"
+	"runtime/debug"
 )
 
 const (
 	BOT_NAME = "Pillar Bot"
+
+	DEFAULT_CONFIG_PATH = "config.yaml"
+	CONFIG_PATH_ENV     = "MATTERMOST_BOT_CONFIG"
 )
 
 type Params struct {
-	Email string `yaml: "email"`
-	Password string `yaml: "password"`
-	Username string `yaml: "username"`
-	FirstName string `yaml: "firstname"`
-	LastName string `yaml: "lastname"`
-	Server string `yaml: "server"`
-	DebugChannel string `yaml: "debugchannel"`
-	Team string `yaml: "team"`
-	Channel string `yaml: "channel"`
-	Autoadd map[string][]string `yaml: "autoadd"`
-	
+	Email string `yaml:"email"`
+	Password string `yaml:"password"`
+	Token string `yaml:"token"`
+	Username string `yaml:"username"`
+	FirstName string `yaml:"firstname"`
+	LastName string `yaml:"lastname"`
+	Server string `yaml:"server"`
+	DebugChannel string `yaml:"debugchannel"`
+	Team string `yaml:"team"`
+	Channel string `yaml:"channel"`
+	Channels []string `yaml:"channels"`
+	Autoadd map[string][]string `yaml:"autoadd"`
+	Admins []string `yaml:"admins"`
+	RejoinMonitoredChannel bool `yaml:"rejoinmonitoredchannel"`
+	LastAddAlertAfter time.Duration `yaml:"lastaddalertafter"`
+	Teams map[string]TeamOptions `yaml:"teams"`
+	WelcomeDM string `yaml:"welcomedm"`
+	WelcomeDMWindow time.Duration `yaml:"welcomedmwindow"`
+	RetryJitter string `yaml:"retryjitter"`
+	StartupHook string `yaml:"startuphook"`
+	LatencySampleInterval time.Duration `yaml:"latencysampleinterval"`
+	WelcomeRetries int `yaml:"welcomeretries"`
+	RequestsPerSecond float64 `yaml:"requestspersecond"`
+	MaxBurstRate float64 `yaml:"maxburstrate"`
+	SkipUsersCreatedBefore string `yaml:"skipuserscreatedbefore"`
+	CreateMissingChannels bool `yaml:"createmissingchannels"`
+	MissingChannelType string `yaml:"missingchanneltype"`
+	MissingChannelPurpose string `yaml:"missingchannelpurpose"`
+	SlowestTracked int `yaml:"slowesttracked"`
+	NoEmailRule string `yaml:"noemailrule"`
+	RuleSets map[string]map[string][]string `yaml:"rulesets"`
+	MaxPostLength int `yaml:"maxpostlength"`
+	WebhookURL string `yaml:"webhookurl"`
+	GlobalConcurrency int `yaml:"globalconcurrency"`
+	TokenExpiryWarning time.Duration `yaml:"tokenexpirywarning"`
+	WelcomeDigest bool `yaml:"welcomedigest"`
+	WelcomeDigestTemplate string `yaml:"welcomedigesttemplate"`
+	LogUnhandledEvents bool `yaml:"logunhandledevents"`
+	GuestAutoadd map[string][]string `yaml:"guestautoadd"`
+	BusinessHours string `yaml:"businesshours"`
+	BusinessTimezone string `yaml:"businesstimezone"`
+	DeferredQueueFile string `yaml:"deferredqueuefile"`
+	IdentityLookupURL string `yaml:"identitylookupurl"`
+	IdentityGroups map[string]string `yaml:"identitygroups"`
+	IdentityCacheTTL time.Duration `yaml:"identitycachettl"`
+	IdentityLookupTimeout time.Duration `yaml:"identitylookuptimeout"`
+	SummaryInterval time.Duration `yaml:"summaryinterval"`
+	CoalesceChannelAdds int `yaml:"coalescechanneladds"`
+	Scheme string `yaml:"scheme"`
+	LogLevel string `yaml:"loglevel"`
+	WelcomeMessage string `yaml:"welcomemessage"`
+	DryRun bool `yaml:"dryrun"`
+	MaxRetries int `yaml:"maxretries"`
+	HealthPort int `yaml:"healthport"`
+	RuleBased []RegexRule `yaml:"rulebased"`
+	ShutdownTimeout time.Duration `yaml:"shutdowntimeout"`
+	AnnounceShutdown bool `yaml:"announceshutdown"`
+	Concurrency int `yaml:"concurrency"`
+	MirrorRemovals map[string][]string `yaml:"mirrorremovals"`
+	AutoaddCooldown time.Duration `yaml:"autoaddcooldown"`
+	ExcludeUsers []string `yaml:"excludeusers"`
+	ExactChannelNames bool `yaml:"exactchannelnames"`
+	MetricsPort int `yaml:"metricsport"`
+	BackfillOnStart bool `yaml:"backfillonstart"`
+	HTTPProxy string `yaml:"httpproxy"`
+	HTTPSProxy string `yaml:"httpsproxy"`
+	SendDMSummary bool `yaml:"senddmsummary"`
+	SkipBots bool `yaml:"skipbots"`
+	BotUsernames []string `yaml:"botusernames"`
+	ChannelCacheTTL time.Duration `yaml:"channelcachettl"`
+	RequireDebugChannel bool `yaml:"requiredebugchannel"`
+	EnableLeaderElection bool `yaml:"enableleaderelection"`
+	LeaderLockFile string `yaml:"leaderlockfile"`
+	LeaderTimeout time.Duration `yaml:"leadertimeout"`
+	NewUserDelay time.Duration `yaml:"newuserdelay"`
+	BotAutoJoinTeams bool `yaml:"botautojointeams"`
+	DomainRouting map[string][]string `yaml:"domainrouting"`
+	StateFile string `yaml:"statefile"`
+	CommandPrefix string `yaml:"commandprefix"`
+	CACertFile string `yaml:"cacertfile"`
+	InsecureSkipVerify bool `yaml:"insecureskipverify"`
+	WebSocketScheme string `yaml:"websocketscheme"`
+	UseTLS *bool `yaml:"usetls"`
+
 }	
 
-var params Params
-var client *model.Client4
+var configPath string
 var webSocketClient *model.WebSocketClient
+var webSocketMutex sync.Mutex
 
 var botUser *model.User
 var botTeam *model.Team
 var currentTeam *model.Team
 var debuggingChannel *model.Channel
-var monitoredChannel *model.Channel
+var debugChannelMutex sync.Mutex
+var debugChannelDisabled bool
+var monitoredChannels []*model.Channel
 var allChannel *model.Channel
 
 var  channelList []string 
@@ -50,20 +136,41 @@ var  channelList []string
 // Documentation for the Go driver can be found
 // at https://godoc.org/github.com/mattermost/platform/model#Client
 func main() {
-	println(BOT_NAME)
+	show_version := flag.Bool("version", false, "print the version and exit")
+	flag.StringVar(&configPath, "config", "", "path to the configuration file (default $"+CONFIG_PATH_ENV+", then "+DEFAULT_CONFIG_PATH+")")
+	flag.Parse()
+
+	if *show_version {
+		fmt.Println(BOT_NAME + " " + VersionString())
+		return
+	}
+
+	logger.Info(BOT_NAME, "version", version, "commit", commit, "built", buildDate)
+
+	configPath = ConfigPath(configPath)
 
 	SetupGracefulShutdown()
 
 	LoadConfiguration();
+	RecordConfigChange(CONFIG_TRIGGER_STARTUP, nil)
+
+	SetupConfigReload()
 
-	client = model.NewAPIv4Client("https://" + params.Server)
+	apiClient = model.NewAPIv4Client(ServerURL())
+	client = rateLimitedClient{apiClient}
+	SetupTransport()
+	apiLimiter.SetRate(RequestsPerSecond())
+	SetupGlobalConcurrency()
+
+	StartHealthServer()
+	StartMetricsServer()
 
 	// Lets test to see if the mattermost server is up and running
 	MakeSureServerIsRunning()
 
 	// lets attempt to login to the Mattermost server as the bot user
 	// This will set the token required for all future calls
-	// You can get this token with client.AuthToken
+	// You can get this token with apiClient.AuthToken
 	LoginAsTheBotUser()
 
 	// If the bot user doesn't have the correct information lets update his profile
@@ -77,92 +184,364 @@ func main() {
 	//client.SetTeamId(botTeam.Id)
 
 	// Lets create a bot channel for logging debug messages into
-	CreateBotDebuggingChannelIfNeeded()
+	SetupDebugChannel()
 	//SendMsgToDebuggingChannel("_"+BOT_NAME+" has **started** running_", "")
 
-	println( "_"+BOT_NAME+" has **started** running_" + params.Server )
+	logger.Info(BOT_NAME+" has started running", "server", Config().Server)
+
+	PersistProcessedUsers()
+
+	StartLeaderElection()
 
 	JoinMonitoredChannel()
 
+	BackfillOnStart()
+
+	WatchLastAdd()
+
+	SampleLatency()
+
+	RetryWelcomes()
+
+	WatchTokenExpiry()
+
+	ProcessDeferredAdds()
+	PostSummaries()
+
 	// Lets start listening to some channels via the websocket!
-	webSocketClient, err := model.NewWebSocketClient("wss://" + params.Server, client.AuthToken)
-	if err != nil {
-		println("We failed to connect to the web socket")
-		PrintError(err)
+	if err := ConnectWebSocket(); err != nil {
+		PrintError("We failed to connect to the web socket", err)
 
 		return
 	}
 
-	webSocketClient.Listen()
+	RunStartupHook()
+
+	// You can block forever with
+	select {}
+}
+
+const (
+	RECONNECT_BASE_DELAY = time.Second
+	RECONNECT_MAX_DELAY  = time.Minute
+)
+
+// ConnectWebSocket opens a websocket with the current auth token and starts
+// handling its events, replacing any previous connection. Should the
+// connection drop, it is reopened with ReconnectWebSocket.
+func ConnectWebSocket() *model.AppError {
+	ws, err := model.NewWebSocketClient(WebSocketURL(), apiClient.AuthToken)
+	if err != nil {
+		return err
+	}
+
+	webSocketMutex.Lock()
+	if webSocketClient != nil {
+		webSocketClient.Close()
+		CountReconnect()
+		metricReconnects.Inc()
+	}
+	webSocketClient = ws
+	webSocketMutex.Unlock()
 
-	go func() {
+	ws.Listen()
+	SetWebSocketConnected(true)
 
-		// add existing users
-		for {
-			select {
-			case resp := <-webSocketClient.EventChannel:
-				HandleWebSocketResponse(resp)
+	StartTask("websocket-listener", func() {
+		for event := range ws.EventChannel {
+			if ShuttingDown() {
+				break
 			}
+			TaskActivity("websocket-listener")
+			HandleWebSocketResponseSafely(event)
 		}
-	}()
 
-	// You can block forever with
-	select {}
+		// A connection that was replaced or shut down on purpose is no
+		// longer the current one
+		webSocketMutex.Lock()
+		dropped := webSocketClient == ws
+		webSocketMutex.Unlock()
+
+		if dropped && !ShuttingDown() {
+			SetWebSocketConnected(false)
+			logger.Warn("The web socket connection was lost")
+			ReconnectWebSocket()
+		}
+	})
+
+	return nil
+}
+
+// ReconnectWebSocket keeps trying to connect again, waiting longer after
+// every failure up to RECONNECT_MAX_DELAY.
+func ReconnectWebSocket() {
+	for attempt := 0; ; attempt++ {
+		delay := BackoffDelay(RECONNECT_BASE_DELAY, RECONNECT_MAX_DELAY, attempt)
+		logger.Info("Reconnecting the web socket", "delay", delay, "attempt", attempt+1)
+		select {
+		case <-shutdownCtx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		err := ConnectWebSocket()
+		if err == nil {
+			logger.Info("Reconnected the web socket")
+			return
+		}
+
+		PrintError("We failed to reconnect the web socket", err)
+	}
+}
+
+// NormalizeServer turns p.Server into host[:port][/path], without
+// surrounding whitespace or a trailing slash. A scheme written in front of
+// it, as in http://mm.example.com, is moved to p.Scheme, where it takes
+// precedence over the scheme and usetls settings.
+func NormalizeServer(p *Params) error {
+	raw := strings.TrimSpace(p.Server)
+	if raw == "" {
+		return errors.New("server is not set")
+	}
+
+	with_scheme := strings.Contains(raw, "://")
+	if !with_scheme {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return errors.New("server has no host: " + p.Server)
+	}
+
+	if with_scheme {
+		scheme := strings.ToLower(u.Scheme)
+		if scheme != "http" && scheme != "https" {
+			return errors.New("server must use http or https, not " + u.Scheme)
+		}
+		if serverScheme(p) != scheme && (p.Scheme != "" || p.UseTLS != nil) {
+			logger.Warn("The server address and scheme disagree, using the scheme of the server address", "server", p.Server, "scheme", p.Scheme)
+		}
+		p.Scheme = scheme
+	}
+
+	p.Server = u.Host + strings.TrimRight(u.Path, "/")
+
+	return nil
+}
+
+// ServerURL is the API address of params.Server
+func ServerURL() string {
+	return serverURL(Config())
+}
+
+func serverURL(p *Params) string {
+	return serverScheme(p) + "://" + p.Server
+}
+
+// serverScheme is p.Scheme when set, else https as the bot always used.
+// Only an explicit usetls: false falls back to plain http.
+func serverScheme(p *Params) string {
+	if p.Scheme != "" {
+		return p.Scheme
+	}
+	if p.UseTLS != nil && !*p.UseTLS {
+		return "http"
+	}
+
+	return "https"
+}
+
+// WebSocketURL is the websocket address of params.Server. Unless
+// params.WebSocketScheme overrides it, it is wss for https and ws for http.
+func WebSocketURL() string {
+	return webSocketURL(Config())
+}
+
+func webSocketURL(p *Params) string {
+	scheme := p.WebSocketScheme
+	if scheme == "" && serverScheme(p) == "https" {
+		scheme = "wss"
+	} else if scheme == "" {
+		scheme = "ws"
+	}
+
+	return scheme + "://" + p.Server
+}
+
+// ConfigPath picks the configuration file: the -config flag, else
+// $MATTERMOST_BOT_CONFIG, else config.yaml in the working directory.
+func ConfigPath(flag_value string) string {
+	if flag_value != "" {
+		return flag_value
+	}
+	if env := os.Getenv(CONFIG_PATH_ENV); env != "" {
+		return env
+	}
+
+	return DEFAULT_CONFIG_PATH
 }
 
 func LoadConfiguration() {
-	source, err := ioutil.ReadFile("config.yaml")
+	logger.Info("Loading configuration", "path", configPath)
+
+	p, err := ReadConfiguration(configPath)
 	if err != nil {
-		panic(err)
+		Fatal("We failed to load the configuration", "path", configPath, "error", err)
 	}
-	err = yaml.Unmarshal(source, &params)
+	templates, err := ReadTemplates(p)
 	if err != nil {
-		panic(err)
+		Fatal("We failed to load the message templates", "error", err)
+	}
+
+	paramsMutex.Lock()
+	SetConfig(p)
+	SetTemplates(templates)
+	paramsMutex.Unlock()
+}
+
+// ReadConfiguration reads and validates a configuration file without
+// applying it.
+func ReadConfiguration(path string) (*Params, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Params{}
+	if err = yaml.Unmarshal(source, p); err != nil {
+		return nil, err
+	}
+	if err = NormalizeServer(p); err != nil {
+		return nil, fmt.Errorf("invalid server: %v", err)
+	}
+	if err = ValidateConfiguration(p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// ValidateConfiguration checks the values that can't be used as they are
+func ValidateConfiguration(p *Params) error {
+	if _, err := ParseLogLevel(p.LogLevel); err != nil {
+		return fmt.Errorf("invalid loglevel: %v", err)
+	}
+	if p.SkipUsersCreatedBefore != "" {
+		if _, err := time.Parse(time.RFC3339, p.SkipUsersCreatedBefore); err != nil {
+			return fmt.Errorf("invalid skipuserscreatedbefore: %v", err)
+		}
+	}
+	if p.Scheme != "" && p.Scheme != "http" && p.Scheme != "https" {
+		return errors.New("scheme must be http or https, not " + p.Scheme)
+	}
+	if p.WebSocketScheme != "" && p.WebSocketScheme != "ws" && p.WebSocketScheme != "wss" {
+		return errors.New("websocketscheme must be ws or wss, not " + p.WebSocketScheme)
+	}
+	switch p.RetryJitter {
+	case "", JITTER_NONE, JITTER_FULL, JITTER_EQUAL:
+	default:
+		return errors.New("retryjitter must be none, full or equal, not " + p.RetryJitter)
+	}
+	if p.MaxPostLength != 0 && p.MaxPostLength < MIN_POST_LENGTH {
+		return fmt.Errorf("maxpostlength must be 0 or at least %d, not %d", MIN_POST_LENGTH, p.MaxPostLength)
+	}
+	if err := ValidateBusinessHours(p); err != nil {
+		return fmt.Errorf("invalid business hours: %v", err)
+	}
+	if err := validateUserPatterns(p.ExcludeUsers); err != nil {
+		return fmt.Errorf("invalid excludeusers pattern: %v", err)
+	}
+	if err := validateUserPatterns(p.BotUsernames); err != nil {
+		return fmt.Errorf("invalid botusernames pattern: %v", err)
+	}
+	if _, err := compileRuleBased(p); err != nil {
+		return fmt.Errorf("invalid rulebased pattern: %v", err)
 	}
+	if err := validateChannelRoles(p); err != nil {
+		return err
+	}
+	if err := validateProxies(p); err != nil {
+		return fmt.Errorf("invalid proxy: %v", err)
+	}
+	if _, err := TLSConfig(p); err != nil {
+		return fmt.Errorf("invalid cacertfile: %v", err)
+	}
+
+	return nil
+}
+
+// ApplyConfiguration updates the state derived from params after it was
+// loaded or reloaded
+func ApplyConfiguration() {
+	SetLogLevel(Config().LogLevel)
+	CompileRuleBased(Config())
 }
 
 func MakeSureServerIsRunning() {
 	if props, resp := client.GetOldClientConfig(""); resp.Error != nil {
-		println("There was a problem pinging the Mattermost server.  Are you sure it's running?")
-		PrintError(resp.Error)
+		PrintError("There was a problem pinging the Mattermost server.  Are you sure it's running?", resp.Error)
 		os.Exit(1)
 	} else {
-		println("Server detected and is running version " + props["Version"])
+		logger.Info("Server detected and is running", "version", props["Version"])
 	}
 }
 
+// LoginAsTheBotUser logs in at startup, retrying while the server is
+// unreachable or failing, and exits if that doesn't work out.
 func LoginAsTheBotUser() {
-	if user, resp := client.Login(params.Email, params.Password); resp.Error != nil {
-		println("There was a problem logging into the Mattermost server.  Are you sure ran the setup steps from the README.md?")
-		PrintError(resp.Error)
+	if err := retryWithBackoff(MaxRetries(), LoginBot); err != nil && Config().Token != "" {
+		PrintError("The configured access token was rejected by the Mattermost server.  Is it still valid?", err)
+		os.Exit(1)
+	} else if err != nil {
+		PrintError("There was a problem logging into the Mattermost server.  Are you sure ran the setup steps from the README.md?", err)
 		os.Exit(1)
+	}
+}
+
+// LoginBot logs in with the configured credentials, which also stores a
+// fresh token in apiClient.AuthToken. With params.Token set the personal
+// access token is used as is, and only checked, instead of the password.
+func LoginBot() *model.AppError {
+	var user *model.User
+	var resp *model.Response
+	if Config().Token != "" {
+		client.SetOAuthToken(Config().Token)
+		user, resp = client.GetMe("")
 	} else {
-		botUser = user
+		user, resp = client.Login(Config().Email, Config().Password)
 	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	botUser = user
+	SetLoggedIn(true)
+	return nil
 }
 
 func UpdateTheBotUserIfNeeded() {
-	if botUser.FirstName != params.FirstName || botUser.LastName != params.LastName || botUser.Username != params.Username {
-		botUser.FirstName = params.FirstName
-		botUser.LastName = params.LastName
-		botUser.Username = params.Username
+	if botUser.FirstName != Config().FirstName || botUser.LastName != Config().LastName || botUser.Username != Config().Username {
+		botUser.FirstName = Config().FirstName
+		botUser.LastName = Config().LastName
+		botUser.Username = Config().Username
 
 		if user, resp := client.UpdateUser(botUser); resp.Error != nil {
-			println("We failed to update the Sample Bot user")
-			PrintError(resp.Error)
+			PrintError("We failed to update the Sample Bot user", resp.Error)
 			os.Exit(1)
 		} else {
 			botUser = user
-			println("Looks like this might be the first run so we've updated the bots account settings")
+			logger.Info("Looks like this might be the first run so we've updated the bots account settings")
 		}
 	}
 }
 
 func FindBotTeam() {
-	if team, resp := client.GetTeamByName(params.Team, ""); resp.Error != nil {
-		println("We failed to get the initial load")
-		println("or we do not appear to be a member of the team '" + params.Team + "'")
-		PrintError(resp.Error)
+	if team, resp := client.GetTeamByName(Config().Team, ""); resp.Error != nil {
+		PrintError("We failed to get the initial load or we do not appear to be a member of the team", resp.Error, "team", Config().Team)
 		os.Exit(1)
 	} else {
 		botTeam = team
@@ -170,240 +549,917 @@ func FindBotTeam() {
 }
 
 func CreateBotDebuggingChannelIfNeeded() {
-	if rchannel, resp := client.GetChannelByName(params.DebugChannel, botTeam.Id, ""); resp.Error != nil {
-		println("We failed to get the channels")
-		PrintError(resp.Error)
+	if rchannel, resp := client.GetChannelByName(Config().DebugChannel, botTeam.Id, ""); resp.Error != nil {
+		PrintError("We failed to get the debugging channel", resp.Error, "channel", Config().DebugChannel)
 	} else {
 		debuggingChannel = rchannel
 		return
 	}
 
 	// Looks like we need to create the logging channel
-	channel := &model.Channel{}
-	channel.Name = params.DebugChannel
-	channel.DisplayName = "Debugging For Sample Bot"
-	channel.Purpose = "This is used as a test channel for logging bot debug messages"
-	channel.Type = model.CHANNEL_OPEN
-	channel.TeamId = botTeam.Id
-	if rchannel, resp := client.CreateChannel(channel); resp.Error != nil {
-		println("We failed to create the channel " + params.DebugChannel)
-		PrintError(resp.Error)
+	if rchannel, err := CreateChannel(botTeam.Id, Config().DebugChannel, "Debugging For Sample Bot", "This is used as a test channel for logging bot debug messages", model.CHANNEL_OPEN); err != nil {
+		PrintError("We failed to create the debugging channel", err, "channel", Config().DebugChannel)
 	} else {
 		debuggingChannel = rchannel
-		println("Looks like this might be the first run so we've created the channel " + params.DebugChannel)
+		logger.Info("Looks like this might be the first run so we've created the debugging channel", "channel", Config().DebugChannel)
 	}
 }
 
-func JoinMonitoredChannel() {
-	if rchannel, resp := client.GetChannelByName(params.Channel, botTeam.Id, ""); resp.Error != nil {
-		println("We failed to get the channels")
-		PrintError(resp.Error)
-	} else {
-		monitoredChannel = rchannel
+func CreateChannel(team_id string, name string, display_name string, purpose string, channel_type string) (*model.Channel, *model.AppError) {
+	channel := &model.Channel{}
+	channel.Name = name
+	channel.DisplayName = display_name
+	channel.Purpose = purpose
+	channel.Type = channel_type
+	channel.TeamId = team_id
 
-		addExistingUsers(monitoredChannel.Id)
+	rchannel, resp := client.CreateChannel(channel)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
 
-		return
+	return rchannel, nil
+}
+
+// MonitoredChannelNames lists params.Channels, with params.Channel in front
+// of them as older configs only set that.
+func MonitoredChannelNames() []string {
+	var names []string
+	if Config().Channel != "" {
+		names = append(names, Config().Channel)
+	}
+	for _, name := range Config().Channels {
+		if !in_array(name, names) {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// MonitoredChannel returns the monitored channel with the given id, or nil
+func MonitoredChannel(channel_id string) *model.Channel {
+	for _, channel := range monitoredChannels {
+		if channel.Id == channel_id {
+			return channel
+		}
 	}
 
-	// TODO: join the channel if failed
+	return nil
+}
+
+// JoinMonitoredChannel resolves the monitored channels, joins those the bot
+// is not a member of yet so that it gets their events, and adds their
+// existing members.
+func JoinMonitoredChannel() {
+	for _, name := range MonitoredChannelNames() {
+		rchannel, resp := client.GetChannelByName(name, botTeam.Id, "")
+		if resp.Error != nil && resp.StatusCode == http.StatusNotFound {
+			logger.Error("The monitored channel does not exist in the bot's team", "channel", name, "team", botTeam.Name)
+			continue
+		} else if resp.Error != nil {
+			PrintError("We failed to get the monitored channel", resp.Error, "channel", name)
+			continue
+		}
+
+		if _, resp := client.GetChannelMember(rchannel.Id, botUser.Id, ""); resp.Error != nil {
+			if _, resp := client.AddChannelMember(rchannel.Id, botUser.Id); resp.Error != nil {
+				PrintError("We failed to join the monitored channel, its events will not reach the bot", resp.Error, "channel", name)
+			} else {
+				logger.Info("Joined the monitored channel", "channel", name)
+			}
+		}
+
+		monitoredChannels = append(monitoredChannels, rchannel)
+	}
 }
 
+// SendMsgToDebuggingChannel posts msg to the debugging channel, split
+// over several posts if it is too long. If the channel was deleted it is
+// created again once, and if that fails posting is disabled and messages
+// go to the log until the config is reloaded.
 func SendMsgToDebuggingChannel(msg string, replyToId string) {
+	for _, part := range SplitMessage(msg, MaxPostLength()) {
+		sendPartToDebuggingChannel(part, replyToId)
+	}
+}
+
+func sendPartToDebuggingChannel(msg string, replyToId string) {
+	debugChannelMutex.Lock()
+	defer debugChannelMutex.Unlock()
+
+	if debuggingChannel == nil || debugChannelDisabled {
+		logger.Info(msg)
+		return
+	}
+
 	post := &model.Post{}
 	post.ChannelId = debuggingChannel.Id
 	post.Message = msg
 
 	post.RootId = replyToId
 
-	if _, resp := client.CreatePost(post); resp.Error != nil {
-		println("We failed to send a message to the logging channel")
-		PrintError(resp.Error)
+	_, resp := client.CreatePost(post)
+	if resp.Error == nil {
+		return
+	}
+	if !isChannelGoneError(resp) {
+		PrintError("We failed to send a message to the logging channel", resp.Error)
+		return
+	}
+
+	logger.Warn("The debugging channel seems to be gone, creating it again", "channel", Config().DebugChannel)
+	debuggingChannel = nil
+	CreateBotDebuggingChannelIfNeeded()
+
+	if debuggingChannel != nil {
+		post.ChannelId = debuggingChannel.Id
+		if _, resp := client.CreatePost(post); resp.Error == nil {
+			return
+		}
+	}
+
+	disableDebugChannel("it is gone and could not be created again")
+	logger.Info(msg)
+}
+
+// SetupDebugChannel finds or creates the debugging channel. When that
+// fails debug messages are logged instead.
+func SetupDebugChannel() {
+	debugChannelMutex.Lock()
+	defer debugChannelMutex.Unlock()
+
+	CreateBotDebuggingChannelIfNeeded()
+	if debuggingChannel == nil && Config().RequireDebugChannel {
+		Fatal("The debugging channel could not be found or created and requiredebugchannel is set", "channel", Config().DebugChannel)
+	}
+	if debuggingChannel == nil {
+		disableDebugChannel("it could not be found or created")
 	}
 }
 
+// DebugChannelAvailable reports whether messages for the debugging channel
+// get posted there rather than only logged
+func DebugChannelAvailable() bool {
+	debugChannelMutex.Lock()
+	defer debugChannelMutex.Unlock()
+
+	return debuggingChannel != nil && !debugChannelDisabled
+}
+
+// disableDebugChannel stops posting to the debugging channel until the
+// configuration is reloaded. The caller must hold debugChannelMutex.
+func disableDebugChannel(reason string) {
+	if debugChannelDisabled {
+		return
+	}
+
+	debugChannelDisabled = true
+	logger.Warn("Posting to the debugging channel is disabled, debug messages go to the log until the configuration is reloaded",
+		"channel", Config().DebugChannel, "reason", reason)
+}
+
+// isChannelGoneError reports whether a failed post was caused by the
+// channel having been deleted.
+func isChannelGoneError(resp *model.Response) bool {
+	return resp.StatusCode == http.StatusNotFound ||
+		resp.Error.Id == "api.post.create_post.can_not_post_to_deleted.error"
+}
 
 // delete message added by Bot
 func deleteBotPostMessage( post_id string ) {
 
 	
 
+	if DryRun("delete the post", "post_id", post_id) {
+		return
+	}
+
 	if _, resp := client.DeletePost(post_id); resp.Error != nil {
-		println("post unable to delete")
-		PrintError(resp.Error)
+		PrintError("post unable to delete", resp.Error, "post_id", post_id)
 	}else{
-		println("bot post  deleted")
+		logger.Debug("bot post deleted", "post_id", post_id)
 	}
 	
 }
 
+// HandleWebSocketResponseSafely handles the event, logging and dropping it
+// should a handler panic on it, so one malformed event can't stop the bot.
+func HandleWebSocketResponseSafely(event *model.WebSocketEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			CountError()
+			logger.Error("Dropped a websocket event that made a handler panic", "event", event.Event,
+				"panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	HandleWebSocketResponse(event)
+}
+
 func HandleWebSocketResponse(event *model.WebSocketEvent) {
+	CountEvent(event.Event)
+	metricEvents.WithLabelValues(event.Event).Inc()
 
+	// Standby instances leave the events to the leader
+	if !IsLeader() {
+		return
+	}
+
+	// Commands keep working while draining so that !resume gets through
 	HandleMsgFromMonitoredChannel(event)
+	if IsDraining() {
+		return
+	}
+
+	HandleBotRemovedFromChannel(event)
+
+	if event.Event == model.WEBSOCKET_EVENT_USER_REMOVED {
+		user_id, channel_id := RemovedUserAndChannel(event)
+		dispatch("mirror-removal", func() { HandleUserRemoved(user_id, channel_id) })
+	}
+
+	if Config().LogUnhandledEvents && !handledEvents[event.Event] {
+		LogUnhandledEvent(event)
+	}
 }
 
-func HandleMsgFromMonitoredChannel(event *model.WebSocketEvent) {
+// Websocket events the handlers above act on
+var handledEvents = map[string]bool{
+	model.WEBSOCKET_EVENT_POSTED:       true,
+	model.WEBSOCKET_EVENT_USER_REMOVED: true,
+}
+
+const (
+	UNHANDLED_EVENT_PREVIEW = 200
+)
 
+// LogUnhandledEvent prints the type and the start of the data of an event
+// the bot ignores, to find out what the server sends.
+func LogUnhandledEvent(event *model.WebSocketEvent) {
+	data, _ := json.Marshal(event.Data)
+	preview := string(data)
+	if len(preview) > UNHANDLED_EVENT_PREVIEW {
+		preview = preview[:UNHANDLED_EVENT_PREVIEW] + "..."
+	}
 
-  
+	logger.Info("unhandled event", "event", event.Event, "data", preview)
+}
 
+func HandleMsgFromMonitoredChannel(event *model.WebSocketEvent) {
 	// Lets only reponded to messaged posted events
 	if event.Event != model.WEBSOCKET_EVENT_POSTED {
 		return
 	}
-    
-		  	
-		
-        
-	post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
-			
-				
-				 if post != nil {
 
-				 	 deleteBotPostMessage(post.Id)
+	data, ok := event.Data["post"].(string)
+	if !ok {
+		logger.Warn("Skipping posted event without a post", "data", event.Data)
+		return
+	}
 
-				 }
+	post := model.PostFromJson(strings.NewReader(data))
+	if post == nil {
+		logger.Warn("Skipping posted event with a malformed post", "data", data)
+		return
+	}
 
+	// Leave our own replies alone, but not the system messages about the
+	// users we added. Ignoring those also keeps us from re-processing our
+	// own adds.
+	if post.UserId == botUser.Id {
+		if strings.HasPrefix(post.Type, "system_") {
+			deleteBotPostMessage(post.Id)
+		}
+		return
+	}
 
-		
-		 
-		
-		}// / end  post event
+	if HandleCommand(post) {
+		return
+	}
 
-		 
+	if IsDraining() {
+		return
+	}
 
-      				
-	
+	if MonitoredChannel(post.ChannelId) != nil {
+		if user_id := JoinedUserId(post); user_id != "" {
+			dispatch("autoadd", func() { AutoaddNewUser(user_id) })
+		}
+	}
 
+	deleteBotPostMessage(post.Id)
+}
 
-func addExistingUsers( channel_id string) {
-	//Page counting starts at 0
-	  //if the users is more than 1000, you need to run for second page,
-	//change 0 to 1,n
-	if existingUsers ,resp  := client.GetUsersInChannel(channel_id,0 ,1000, "");
+// JoinedUserId returns the user who joined or was added to the channel by
+// the given system post, or "" for any other post.
+func JoinedUserId(post *model.Post) string {
+	switch post.Type {
+	case model.POST_JOIN_CHANNEL:
+		return post.UserId
 
-			  resp != nil{
-			 	for i,existingUser := range existingUsers{
-			 		
-			 		HandleNewUserOrExistingUserAdding(existingUser.Id)
-			 		println(" user number" + strconv.Itoa(i))
-			 		time.Sleep(10 * time.Second)
+	case model.POST_ADD_TO_CHANNEL:
+		if user_id, ok := post.Props["addedUserId"].(string); ok && user_id != "" {
+			return user_id
+		}
 
-			 	}
+		// Older servers only send the username
+		username, ok := post.Props["addedUsername"].(string)
+		if !ok || username == "" {
+			return ""
+		}
+		user, resp := client.GetUserByUsername(username, "")
+		if resp.Error != nil {
+			PrintError("We failed to look up added user", resp.Error, "username", username)
+			return ""
+		}
+		if user == nil {
+			logger.Warn("The server returned no user for the added username", "username", username)
+			return ""
+		}
+		return user.Id
+	}
 
-			 	println(" existing Users added")
-			 	
-			 }
+	return ""
 }
 
-func AddUserToTeam(user string, team_id string, team_name string, channels []string, tr *model.Team) {
-	_, resp  := client.AddTeamMember( team_id, user);
-	if resp.Error != nil {
-		// SendMsgToDebuggingChannel("Could not add user to team!", "")
-		println("Could not add user to team!" + team_id)
+// RemovedUserAndChannel returns who was removed from which channel by a
+// user_removed event. The event sent to the removed user carries the
+// channel in its data, the one broadcast to the channel carries the removed
+// user instead.
+func RemovedUserAndChannel(event *model.WebSocketEvent) (string, string) {
+	user_id, _ := event.Data["user_id"].(string)
+	channel_id, _ := event.Data["channel_id"].(string)
+	if event.Broadcast != nil {
+		if user_id == "" {
+			user_id = event.Broadcast.UserId
+		}
+		if channel_id == "" {
+			channel_id = event.Broadcast.ChannelId
+		}
+	}
 
+	return user_id, channel_id
+}
+
+// HandleBotRemovedFromChannel raises an alert when the bot itself is removed
+// from a monitored channel and, if configured, joins it again.
+func HandleBotRemovedFromChannel(event *model.WebSocketEvent) {
+	if event.Event != model.WEBSOCKET_EVENT_USER_REMOVED {
 		return
 	}
 
-	for _, channel_to_join := range channels {
-		rchannel, resp1 := client.GetChannelByName(channel_to_join, team_id, "");
-		if resp1.Error != nil {
-			// SendMsgToDebuggingChannel("Could not get channel by name: " + channel_to_join, "")
+	user_id, channel_id := RemovedUserAndChannel(event)
 
-			continue
+	monitoredChannel := MonitoredChannel(channel_id)
+	if user_id != botUser.Id || monitoredChannel == nil {
+		return
+	}
+
+	logger.Error("!!! "+BOT_NAME+" was removed from the monitored channel and will not see new users !!!", "channel", monitoredChannel.Name)
+
+	if !Config().RejoinMonitoredChannel {
+		return
+	}
+
+	if _, resp := client.AddChannelMember(monitoredChannel.Id, botUser.Id); resp.Error != nil {
+		PrintError("We failed to rejoin the monitored channel", resp.Error, "channel", monitoredChannel.Name)
+	} else {
+		logger.Info("Rejoined the monitored channel", "channel", monitoredChannel.Name)
+	}
+}
+
+// AddUserToTeam adds the user to the team and then to each of the
+// channels. It returns the channels the user was added to, and false if
+// the user could not be added to the team.
+func AddUserToTeam(user string, team_id string, team_name string, channels []string, tr *model.Team) ([]string, bool) {
+	EnsureBotInTeam(team_id, team_name)
+
+	var err *model.AppError
+	if !DryRun("add the user to the team", "user_id", user, "team", team_name) {
+		err = retryWithBackoff(MaxRetries(), func() *model.AppError {
+			acquireAddSlot()
+			defer releaseAddSlot()
+
+			_, resp := client.AddTeamMember(team_id, user)
+			return resp.Error
+		})
+	}
+	CountAddResult(METRICS_TARGET_TEAM, err == nil)
+	if err != nil {
+		reportError("Could not add user "+user+" to team "+team_name, err)
+
+		return nil, false
+	}
+
+	CountDestination(team_name, "")
+
+	PostLandingMessage(user, team_id, team_name)
+
+	// With many channels, one paged listing of the team's public channels
+	// replaces most of the per-channel lookups. The server has no call to
+	// add a user to several channels at once, so the adds stay one per
+	// channel.
+	var known map[string]*model.Channel
+	lookups := 0
+	if Config().CoalesceChannelAdds > 0 && len(channels) >= Config().CoalesceChannelAdds {
+		known, lookups = PublicChannelsByName(team_id)
+	}
+
+	var welcome_user *model.User
+	if HasChannelWelcomes(team_name) {
+		var resp *model.Response
+		if welcome_user, resp = client.GetUser(user, ""); resp.Error != nil {
+			PrintError("We failed to look up the user for the welcome message", resp.Error, "user_id", user)
 		}
+	}
 
-		_, err := AddUserToChannel(rchannel.Id , user , "member")
-		if err != nil {
-			//SendMsgToDebuggingChannel("Could not join channel: " + channel_to_join, "")
+	// The channels are worked through by up to ChannelConcurrency() workers
+	// sharing the client; the results keep the order of the rule.
+	var lookupCount = int32(lookups)
+	added := make([]bool, len(channels))
+	var failures []string
+	var failuresMutex sync.Mutex
+
+	jobs := make(chan int)
+	var workers sync.WaitGroup
+	for w := 0; w < ChannelConcurrency(); w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range jobs {
+				ok, err := joinChannel(user, team_id, team_name, channels[i], known, welcome_user, &lookupCount)
+				added[i] = ok
+				if err != nil {
+					failuresMutex.Lock()
+					failures = append(failures, channels[i]+": "+err.Message)
+					failuresMutex.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range channels {
+		jobs <- i
+	}
+	close(jobs)
+	workers.Wait()
 
-			println("Could not join channel: " + channel_to_join)
-			PrintError(err)
+	var joined []string
+	for i, ok := range added {
+		if ok {
+			joined = append(joined, channels[i])
 		}
 	}
+
+	if len(failures) > 0 {
+		logger.Warn("Some channels could not be joined", "user_id", user, "team", team_name,
+			"failed", len(failures), "errors", strings.Join(failures, "; "))
+	}
+
+	if known != nil {
+		logger.Info("Looked up the channels with a listing of the team", "team", team_name,
+			"channels", len(channels), "calls", atomic.LoadInt32(&lookupCount))
+	}
+
+	return joined, true
 }
 
+const (
+	DEFAULT_CHANNEL_CONCURRENCY = 4
+)
 
-func HandleNewUserOrExistingUserAdding( user_id string) {
+// ChannelConcurrency is how many channels of a team a user is added to at
+// once, params.Concurrency or DEFAULT_CHANNEL_CONCURRENCY.
+func ChannelConcurrency() int {
+	if Config().Concurrency <= 0 {
+		return DEFAULT_CHANNEL_CONCURRENCY
+	}
 
+	return Config().Concurrency
+}
 
-	  println("add to all channels" + user_id)
+// joinChannel adds the user to one channel of the team, looking it up in
+// known first, and greets them there. It returns whether the user was
+// added.
+func joinChannel(user string, team_id string, team_name string, channel_to_join string,
+	known map[string]*model.Channel, welcome_user *model.User, lookups *int32) (bool, *model.AppError) {
+	rchannel, ok := known[channel_to_join]
+	if !ok {
+		atomic.AddInt32(lookups, 1)
+
+		var resp1 *model.Response
+		rchannel, resp1 = CachedResolveChannel(channel_to_join, team_id)
+		if resp1.Error != nil && resp1.StatusCode == http.StatusNotFound && Config().CreateMissingChannels &&
+			!strings.HasPrefix(channel_to_join, CHANNEL_ID_PREFIX) {
+			rchannel = CreateMissingChannel(team_id, team_name, channel_to_join)
+		} else if resp1.Error != nil {
+			reportError("Could not get channel "+channel_to_join+" of team "+team_name, resp1.Error)
+			return false, resp1.Error
+		}
+	}
+	if rchannel == nil {
+		return false, nil
+	}
+	if !CanAddMembers(rchannel) {
+		logger.Debug("skipping channel the bot can't add members to", "channel", channel_to_join, "team", team_name)
+		return false, nil
+	}
 
-	for k, v := range params.Autoadd {
+	err := retryWithBackoff(MaxRetries(), func() *model.AppError {
+		_, err := AddUserToChannel(rchannel.Id, user, ChannelRoles(team_name, rchannel.Name))
+		return err
+	})
+	CountAddResult(METRICS_TARGET_CHANNEL, err == nil)
+	if err != nil {
+		RecordAddRefused(rchannel, team_name, err)
+		reportError("Could not add user "+user+" to channel "+channel_to_join, err)
+		return false, err
+	}
 
-				if team, resp := client.GetTeamByName(k, ""); resp.Error == nil {
+	CountDestination(team_name, channel_to_join)
 
+	if welcome_user != nil {
+		PostChannelWelcome(welcome_user, rchannel, team_name)
+	}
 
-						// if its the pillar team, add user to channnel too
-                         if(k == "pillarteam"){
-					
-						 println("add to all channels" + k)
+	return true, nil
+}
 
+// Autoadd channel entries starting with CHANNEL_ID_PREFIX name the channel
+// by id, for private channels whose name can't be looked up reliably.
+const (
+	CHANNEL_ID_PREFIX = "id:"
+)
 
+// ResolveChannel looks up a channel entry of an autoadd rule, either a
+// channel name in the team or id:<channel id>.
+func ResolveChannel(entry string, team_id string) (*model.Channel, *model.Response) {
+	if strings.HasPrefix(entry, CHANNEL_ID_PREFIX) {
+		return client.GetChannel(strings.TrimPrefix(entry, CHANNEL_ID_PREFIX), "")
+	}
 
-					if allChannel , err := client.GetPublicChannelsForTeam(team.Id,0,100 , ""); err.Error == nil{
-					 	
-                         channelList := make([]string, len(allChannel))
+	if !Config().ExactChannelNames {
+		entry = strings.ToLower(entry)
+	}
 
-						 for i, channelInTeam := range allChannel{
+	return client.GetChannelByName(entry, team_id, "")
+}
 
+// PublicChannels lists every public channel of the team, a page at a time
+// until the server runs out of them. It also returns the number of API
+// calls that took.
+func PublicChannels(team_id string) ([]*model.Channel, int, *model.AppError) {
+	var channels []*model.Channel
+	calls := 0
+	for page := 0; ; page++ {
+		calls++
+		apiLimiter.Wait()
+		list, resp := client.GetPublicChannelsForTeam(team_id, page, BACKFILL_PAGE_SIZE, "")
+		if resp.Error != nil {
+			return channels, calls, resp.Error
+		}
 
-						 isChannelAvailable :=in_array(channelInTeam.Name, v)
+		channels = append(channels, list...)
+		if len(list) < BACKFILL_PAGE_SIZE {
+			break
+		}
+	}
 
-						 	 if !isChannelAvailable{
- 							
- 								channelList[i] = channelInTeam.Name
+	return channels, calls, nil
+}
 
- 								}
- 								
- 								}
- 							AddUserToTeam(user_id, team.Id, k, channelList, team)
- 							}
+// PublicChannelsByName lists every public channel of the team by name. It
+// also returns the number of API calls that took.
+func PublicChannelsByName(team_id string) (map[string]*model.Channel, int) {
+	list, calls, err := PublicChannels(team_id)
+	if err != nil {
+		PrintError("We failed to list the public channels of team", err, "team_id", team_id)
+	}
 
-						 	 	
+	channels := map[string]*model.Channel{}
+	for _, channel := range list {
+		channels[channel.Name] = channel
+	}
 
-						}else{
-					
-					  AddUserToTeam(user_id, team.Id, k, v, team)
-					}
-						
-					
-				} else {
-					//SendMsgToDebuggingChannel(" error getting team " + k, "")
-					println( " error getting team " + k, "")
+	return channels, calls
+}
 
-					PrintError(resp.Error)
-				}
+// Autoadd modes. In AUTOADD_MODE_ALL_EXCEPT a user joins every public channel
+// of the team except the configured ones, in AUTOADD_MODE_ONLY_LISTED only
+// the configured channels.
+const (
+	AUTOADD_MODE_ALL_EXCEPT  = "all-except"
+	AUTOADD_MODE_ONLY_LISTED = "only-listed"
+)
 
-			}
-	
+// AutoaddMode returns how the channel list of the team's rule is applied.
+// It comes from the team's "mode" option; pillarteam defaults to
+// AUTOADD_MODE_ALL_EXCEPT as it always has.
+func AutoaddMode(team_name string) string {
+	if mode := Config().Teams[team_name].Mode; mode != "" {
+		return mode
+	}
+
+	if team_name == "pillarteam" {
+		return AUTOADD_MODE_ALL_EXCEPT
+	}
+
+	return AUTOADD_MODE_ONLY_LISTED
 }
 
-// https://api.mattermost.com/#tag/channels%2Fpaths%2F~1channels~1%7Bchannel_id%7D~1members%2Fpost
-func AddUserToChannel(channel_id string, user_id string, roles string) (*model.Result, *model.AppError) {
-	//request := fmt.Sprintf(`{
-	//	"channel_id": %s,
-	//	"user_id": %s,
-	//	"roles": %s,
-	//	}`, channel_id, user_id, roles)
+// ChannelsToJoin returns the names of the channels a user is added to in
+// the team according to the team's autoadd rule.
+func ChannelsToJoin(team *model.Team, team_name string, rule []string) ([]string, *model.AppError) {
+	if AutoaddMode(team_name) != AUTOADD_MODE_ALL_EXCEPT {
+		return rule, nil
+	}
 
-	member := model.ChannelMember{ChannelId: channel_id, UserId: user_id}
-	request := member.ToJson()
+	logger.Debug("add to all channels", "team", team_name)
 
-	if r, err := client.DoApiPost("/channels/" + channel_id + "/members", request); err != nil {
+	allChannel, _, err := PublicChannels(team.Id)
+	if err != nil {
 		return nil, err
-	} else {
-		//defer model.closeBody(r)
-		return &model.Result{r.Header.Get(model.HEADER_REQUEST_ID),
-			r.Header.Get(model.HEADER_ETAG_SERVER), model.TeamFromJson(r.Body)}, nil
 	}
+
+	channelList := []string{}
+	for _, channelInTeam := range allChannel {
+		isChannelAvailable := ChannelInRule(channelInTeam.Name, rule) || in_array(CHANNEL_ID_PREFIX+channelInTeam.Id, rule)
+
+		if !isChannelAvailable && !in_array(channelInTeam.Name, channelList) && CanAddMembers(channelInTeam) {
+			channelList = append(channelList, channelInTeam.Name)
+		}
+	}
+
+	return channelList, nil
+}
+
+// CreatedBeforeCutoff reports whether the user's account is older than
+// params.SkipUsersCreatedBefore and should be left alone.
+func CreatedBeforeCutoff(user *model.User) bool {
+	if Config().SkipUsersCreatedBefore == "" {
+		return false
+	}
+
+	cutoff, err := time.Parse(time.RFC3339, Config().SkipUsersCreatedBefore)
+	if err != nil {
+		return false
+	}
+
+	return user.CreateAt < cutoff.UnixNano()/int64(time.Millisecond)
 }
 
-func PrintError(err *model.AppError) {
-	println("\tError Details:")
-	println("\t\t" + err.Message)
-	println("\t\t" + err.Id)
-	println("\t\t" + err.DetailedError)
+// CreateMissingChannel creates a channel referenced by an autoadd rule that
+// does not exist yet, using the configured type and purpose.
+func CreateMissingChannel(team_id string, team_name string, name string) *model.Channel {
+	channel_type := model.CHANNEL_OPEN
+	if Config().MissingChannelType == "private" {
+		channel_type = model.CHANNEL_PRIVATE
+	}
+
+	if DryRun("create the missing channel", "channel", name, "team", team_name) {
+		return &model.Channel{Name: name, TeamId: team_id, Type: channel_type}
+	}
+
+	var channel *model.Channel
+	err := retryWithBackoff(MaxRetries(), func() *model.AppError {
+		var err *model.AppError
+		channel, err = CreateChannel(team_id, name, name, Config().MissingChannelPurpose, channel_type)
+		return err
+	})
+	if err != nil {
+		PrintError("We failed to create the missing channel", err, "channel", name, "team", team_name)
+		return nil
+	}
+
+	logger.Info("Created the missing channel", "channel", name, "team", team_name)
+	return channel
+}
+
+// IsGuest reports whether the user has a guest account
+func IsGuest(user *model.User) bool {
+	for _, role := range strings.Fields(user.Roles) {
+		if role == "system_guest" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsBotAccount reports whether the user is a bot. This server API has no
+// flag for bots, so they are the users params.BotUsernames lists, or when
+// it is empty the accounts without an email address. In that case
+// params.SkipBots leaves them alone before params.NoEmailRule is applied.
+func IsBotAccount(user *model.User) bool {
+	if len(Config().BotUsernames) > 0 {
+		return listsUser(Config().BotUsernames, user)
+	}
+
+	return user.Email == ""
+}
+
+// Values of params.NoEmailRule besides the name of a rule set
+const (
+	NO_EMAIL_RULE_SKIP    = "skip"
+	NO_EMAIL_RULE_DEFAULT = "default"
+)
+
+// RulesFor returns the autoadd rules that apply to the user, or nil if the
+// user should not be processed at all. Guests only ever get
+// params.GuestAutoadd. Users without an email address, such as
+// integrations, get params.NoEmailRule. Matching rulebased rules and the
+// teams of params.DomainRouting are added on top for everyone else.
+func RulesFor(user *model.User) map[string][]string {
+	return RulesWith(Config(), user)
+}
+
+// RulesWith is RulesFor evaluated against p instead of the running
+// configuration, e.g. with a proposed autoadd map swapped in.
+func RulesWith(p *Params, user *model.User) map[string][]string {
+	if IsGuest(user) {
+		return p.GuestAutoadd
+	}
+
+	return WithDomainRouting(p, user, WithMatchingRules(p, user, defaultRulesFor(p, user)))
+}
+
+func defaultRulesFor(p *Params, user *model.User) map[string][]string {
+	if p.IdentityLookupURL != "" {
+		if rules, ok := IdentityRules(user); ok {
+			return rules
+		}
+	}
+
+	if user.Email != "" {
+		return p.Autoadd
+	}
+
+	switch p.NoEmailRule {
+	case "", NO_EMAIL_RULE_DEFAULT:
+		return p.Autoadd
+	case NO_EMAIL_RULE_SKIP:
+		return nil
+	}
+
+	rules, ok := p.RuleSets[p.NoEmailRule]
+	if !ok {
+		logger.Warn("noemailrule names an unknown rule set, using the default rules", "noemailrule", p.NoEmailRule)
+		return p.Autoadd
+	}
+
+	return rules
+}
+
+// HandleNewUserOrExistingUserAdding runs autoadd for the user and returns
+// the teams they were added to.
+func HandleNewUserOrExistingUserAdding(user_id string) []string {
+	// The bot's own joins would otherwise feed back into autoadd
+	if botUser != nil && user_id == botUser.Id {
+		logger.Debug("skipping the bot itself", "user_id", user_id)
+		return nil
+	}
+
+	if ShuttingDown() {
+		logger.Info("shutting down, not adding user", "user_id", user_id)
+		return nil
+	}
+
+	if RecentlyProcessed(user_id) {
+		logger.Info("skipping user processed within the cooldown", "user_id", user_id, "cooldown", Config().AutoaddCooldown)
+		return nil
+	}
+
+	logger.Info("adding user", "user_id", user_id)
+
+	if !beginAdd() {
+		logger.Info("shutting down, not adding user", "user_id", user_id)
+		return nil
+	}
+	defer endAdd()
+
+	user, resp := client.GetUser(user_id, "")
+	if resp.Error != nil {
+		PrintError("We failed to look up user", resp.Error, "user_id", user_id)
+		return nil
+	}
+
+	if user.DeleteAt != 0 {
+		logger.Info("skipping deactivated user", "user_id", user_id, "username", user.Username)
+		return nil
+	}
+
+	if Config().SkipBots && IsBotAccount(user) {
+		logger.Info("skipping bot account", "user_id", user_id, "username", user.Username)
+		return nil
+	}
+
+	if IsExcluded(user) {
+		logger.Info("skipping excluded user", "user_id", user_id, "username", user.Username)
+		return nil
+	}
+
+	if CreatedBeforeCutoff(user) {
+		logger.Info("skipping user created before the cutoff", "user_id", user_id, "cutoff", Config().SkipUsersCreatedBefore)
+		return nil
+	}
+
+	paramsMutex.RLock()
+	rules := RulesFor(user)
+	paramsMutex.RUnlock()
+	if rules == nil {
+		logger.Info("skipping user, no autoadd rules apply", "user_id", user_id)
+		return nil
+	}
+
+	var added_teams []string
+	joined_channels := map[string][]string{}
+	for k, v := range rules {
+		team, resp := client.GetTeamByName(k, "")
+		if resp.Error != nil {
+			reportError("Could not get team "+k, resp.Error)
+			continue
+		}
+
+		// Guests only ever join the channels listed for them
+		channelList := v
+		if !IsGuest(user) {
+			var err *model.AppError
+			channelList, err = ChannelsToJoin(team, k, v)
+			if err != nil {
+				PrintError("We failed to get the public channels of team", err, "team", k)
+				continue
+			}
+		}
+
+		start := time.Now()
+		if joined, ok := AddUserToTeam(user_id, team.Id, k, channelList, team); ok {
+			added_teams = append(added_teams, k)
+			joined_channels[k] = joined
+		}
+		RecordAddTiming(AddTiming{UserId: user_id, Team: k, Channels: len(channelList), Duration: time.Since(start), At: time.Now()})
+	}
+
+	if len(added_teams) > 0 {
+		RecordSuccessfulAdd()
+		SendWelcome(user, added_teams, joined_channels)
+	}
+
+	return added_teams
+}
+
+// AddUserToChannel adds the user to the channel and, unless roles is the
+// plain member role, gives them roles there.
+func AddUserToChannel(channel_id string, user_id string, roles string) (*model.ChannelMember, *model.AppError) {
+	if DryRun("add the user to the channel", "user_id", user_id, "channel_id", channel_id, "roles", roles) {
+		return &model.ChannelMember{ChannelId: channel_id, UserId: user_id, Roles: roles}, nil
+	}
+
+	acquireAddSlot()
+	defer releaseAddSlot()
+
+	member, resp := client.AddChannelMember(channel_id, user_id)
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	if roles != "" && roles != model.CHANNEL_USER_ROLE_ID {
+		if _, resp := client.UpdateChannelRoles(channel_id, user_id, roles); resp.Error != nil {
+			return nil, resp.Error
+		}
+		member.Roles = roles
+	}
+
+	return member, nil
+}
+
+// Channel roles a team's "channels" options may give the users added there
+const (
+	CHANNEL_ROLE_MEMBER = "member"
+	CHANNEL_ROLE_ADMIN  = "channel_admin"
+)
+
+// ChannelRoles returns the roles users get in the channel, as the server
+// spells them, from the channel's "role" option. Plain members get
+// model.CHANNEL_USER_ROLE_ID.
+func ChannelRoles(team_name string, channel_name string) string {
+	if Config().Teams[team_name].Channels[channel_name].Role == CHANNEL_ROLE_ADMIN {
+		return model.CHANNEL_USER_ROLE_ID + " " + model.CHANNEL_ADMIN_ROLE_ID
+	}
+
+	return model.CHANNEL_USER_ROLE_ID
+}
+
+// validateChannelRoles checks the "role" options of every team's channels
+func validateChannelRoles(p *Params) error {
+	for team_name, options := range p.Teams {
+		for channel_name, channel := range options.Channels {
+			if channel.Role != "" && channel.Role != CHANNEL_ROLE_MEMBER && channel.Role != CHANNEL_ROLE_ADMIN {
+				return errors.New("role of " + team_name + "/" + channel_name + " must be member or channel_admin, not " + channel.Role)
+			}
+		}
+	}
+
+	return nil
 }
 
 // array to check if exist
@@ -423,17 +1479,70 @@ func in_array(val string, array []string) (exists bool) {
     return
 }
 
+// in_array_fold is in_array ignoring case
+func in_array_fold(val string, array []string) bool {
+	for _, v := range array {
+		if strings.EqualFold(val, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ChannelInRule reports whether a channel name is listed in an autoadd
+// rule. Channel names are lowercase on the server, so case is ignored
+// unless params.ExactChannelNames is set.
+func ChannelInRule(name string, rule []string) bool {
+	if Config().ExactChannelNames {
+		return in_array(name, rule)
+	}
+
+	return in_array_fold(name, rule)
+}
+
+const (
+	DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+)
+
+// SetupGracefulShutdown stops the bot on SIGINT or SIGTERM: no new events
+// are handled, the users being added are given params.ShutdownTimeout to
+// finish, and queued welcome messages are sent before exiting.
 func SetupGracefulShutdown() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for _ = range c {
-			if webSocketClient != nil {
-				webSocketClient.Close()
-			}
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	StartTask("signal-handler", func() {
+		sig := <-c
+		logger.Info("Shutting down", "signal", sig.String())
 
-			//SendMsgToDebuggingChannel("_"+BOT_NAME+" has **stopped** running_", "")
-			os.Exit(0)
+		cancelShutdown()
+
+		webSocketMutex.Lock()
+		if webSocketClient != nil {
+			webSocketClient.Close()
+			webSocketClient = nil
 		}
-	}()
+		webSocketMutex.Unlock()
+		SetWebSocketConnected(false)
+
+		timeout := Config().ShutdownTimeout
+		if timeout <= 0 {
+			timeout = DEFAULT_SHUTDOWN_TIMEOUT
+		}
+		if !WaitForAdds(timeout) {
+			logger.Warn("Gave up waiting for the users being added", "in_flight", InFlightAdds())
+		}
+
+		StopHealthServer()
+		StopMetricsServer()
+		ReleaseLeadership()
+		SaveProcessedUsers()
+
+		DrainPendingWelcomes()
+
+		if Config().AnnounceShutdown {
+			SendMsgToDebuggingChannel("_"+BOT_NAME+" has **stopped** running_", "")
+		}
+		os.Exit(0)
+	})
 }
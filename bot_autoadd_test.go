@@ -0,0 +1,575 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// setupAutoadd gives the fake server an "eng" team with only-listed
+// channels and the all-except "pillarteam", and the user "jane" to add.
+func setupAutoadd(t *testing.T) *fakeClient {
+	withConfig(t, &Params{
+		Autoadd: map[string][]string{
+			"eng":        {"builds", "town-square"},
+			"pillarteam": {"off-topic"},
+		},
+	})
+
+	fake := withFakeClient(t)
+	ResetChannelAccess()
+	t.Cleanup(ResetChannelAccess)
+
+	eng := fake.addTeam("eng")
+	fake.addChannel(eng, "builds", model.CHANNEL_OPEN)
+	fake.addChannel(eng, "town-square", model.CHANNEL_OPEN)
+	fake.addChannel(eng, "random", model.CHANNEL_OPEN)
+
+	pillar := fake.addTeam("pillarteam")
+	fake.addChannel(pillar, "town-square", model.CHANNEL_OPEN)
+	fake.addChannel(pillar, "off-topic", model.CHANNEL_OPEN)
+	fake.addChannel(pillar, "random", model.CHANNEL_OPEN)
+	fake.addChannel(pillar, "secret", model.CHANNEL_PRIVATE)
+
+	fake.addUser(&model.User{Id: "jane", Username: "jane", Email: "jane@example.com"})
+
+	return fake
+}
+
+func TestHandleNewUserOrExistingUserAdding(t *testing.T) {
+	fake := setupAutoadd(t)
+
+	teams := HandleNewUserOrExistingUserAdding("jane")
+	sort.Strings(teams)
+	if expected := []string{"eng", "pillarteam"}; !reflect.DeepEqual(teams, expected) {
+		t.Errorf("added to teams %v, expected %v", teams, expected)
+	}
+
+	expected := []string{
+		"AddTeamMember team-eng jane",
+		"AddTeamMember team-pillarteam jane",
+	}
+	if calls := fake.sortedCalls("AddTeamMember"); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("team adds %q, expected %q", calls, expected)
+	}
+
+	// pillarteam adds to every public channel but the excluded off-topic
+	expected = []string{
+		"AddChannelMember eng-builds jane",
+		"AddChannelMember eng-town-square jane",
+		"AddChannelMember pillarteam-random jane",
+		"AddChannelMember pillarteam-town-square jane",
+	}
+	if calls := fake.sortedCalls("AddChannelMember"); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("channel adds %q, expected %q", calls, expected)
+	}
+}
+
+func TestHandleNewUserOrExistingUserAddingFailures(t *testing.T) {
+	fake := setupAutoadd(t)
+	fake.failOn("AddTeamMember team-eng jane", http.StatusForbidden)
+	fake.failOn("AddChannelMember pillarteam-random jane", http.StatusForbidden)
+
+	teams := HandleNewUserOrExistingUserAdding("jane")
+	if expected := []string{"pillarteam"}; !reflect.DeepEqual(teams, expected) {
+		t.Errorf("added to teams %v, expected %v", teams, expected)
+	}
+
+	// No channels of a team the user couldn't join, and a failed channel
+	// doesn't stop the others
+	expected := []string{
+		"AddChannelMember pillarteam-random jane",
+		"AddChannelMember pillarteam-town-square jane",
+	}
+	if calls := fake.sortedCalls("AddChannelMember"); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("channel adds %q, expected %q", calls, expected)
+	}
+	if fake.channelMembers["pillarteam-random"]["jane"] != "" {
+		t.Error("jane is in pillarteam/random after the add failed")
+	}
+}
+
+func TestHandleNewUserOrExistingUserAddingSkips(t *testing.T) {
+	tests := []struct {
+		name  string
+		user  *model.User
+		setup func(p *Params)
+	}{
+		{"deactivated", &model.User{Id: "gone", Username: "gone", Email: "gone@example.com", DeleteAt: 1}, nil},
+		{"excluded", &model.User{Id: "ex", Username: "ex", Email: "ex@example.com"}, func(p *Params) {
+			p.ExcludeUsers = []string{"@ex"}
+		}},
+		{"bot account", &model.User{Id: "robot", Username: "robot"}, func(p *Params) {
+			p.SkipBots = true
+		}},
+	}
+
+	for _, test := range tests {
+		fake := setupAutoadd(t)
+		if test.setup != nil {
+			p := *Config()
+			test.setup(&p)
+			withConfig(t, &p)
+		}
+		fake.addUser(test.user)
+
+		if teams := HandleNewUserOrExistingUserAdding(test.user.Id); teams != nil {
+			t.Errorf("%s: added to %v", test.name, teams)
+		}
+		if calls := fake.called("AddTeamMember", "AddChannelMember"); len(calls) > 0 {
+			t.Errorf("%s: made %q", test.name, calls)
+		}
+	}
+}
+
+func TestAddUserToTeam(t *testing.T) {
+	fake := setupAutoadd(t)
+	team := fake.teams["team-eng"]
+
+	joined, ok := AddUserToTeam("jane", team.Id, "eng", []string{"builds", "missing", "town-square"}, team)
+	if !ok {
+		t.Fatal("the team add failed")
+	}
+	sort.Strings(joined)
+	if expected := []string{"builds", "town-square"}; !reflect.DeepEqual(joined, expected) {
+		t.Errorf("joined %v, expected %v", joined, expected)
+	}
+	if !fake.teamMembers[team.Id]["jane"] {
+		t.Error("jane is not in the team")
+	}
+
+	fake.failOn("AddTeamMember team-pillarteam jane", http.StatusForbidden)
+	pillar := fake.teams["team-pillarteam"]
+	if joined, ok := AddUserToTeam("jane", pillar.Id, "pillarteam", []string{"random"}, pillar); ok || joined != nil {
+		t.Errorf("a failed team add returned %v, %v", joined, ok)
+	}
+	if calls := fake.called("AddChannelMember " + pillar.Name); len(calls) > 0 {
+		t.Errorf("channels were joined after the team add failed: %q", calls)
+	}
+}
+
+func TestAddUserToTeamCreatesMissingChannels(t *testing.T) {
+	fake := setupAutoadd(t)
+	team := fake.teams["team-eng"]
+
+	// Off by default, the add to the missing channel just fails
+	joined, _ := AddUserToTeam("jane", team.Id, "eng", []string{"builds", "announcements"}, team)
+	if expected := []string{"builds"}; !reflect.DeepEqual(joined, expected) {
+		t.Errorf("joined %v, expected %v", joined, expected)
+	}
+	if calls := fake.called("CreateChannel"); len(calls) > 0 {
+		t.Errorf("created a channel with createmissingchannels off: %q", calls)
+	}
+
+	p := *Config()
+	p.CreateMissingChannels = true
+	p.MissingChannelPurpose = "Team news"
+	withConfig(t, &p)
+
+	joined, _ = AddUserToTeam("jane", team.Id, "eng", []string{"builds", "announcements"}, team)
+	sort.Strings(joined)
+	if expected := []string{"announcements", "builds"}; !reflect.DeepEqual(joined, expected) {
+		t.Errorf("joined %v, expected %v", joined, expected)
+	}
+
+	created := fake.channels["eng-announcements"]
+	if created == nil {
+		t.Fatalf("the missing channel wasn't created: %q", fake.called("CreateChannel"))
+	}
+	if created.Type != model.CHANNEL_OPEN || created.Purpose != "Team news" {
+		t.Errorf("created %+v, expected an open channel with the configured purpose", created)
+	}
+	if fake.channelMembers[created.Id]["jane"] == "" {
+		t.Error("jane was not added to the created channel")
+	}
+}
+
+func TestHandleNewUserOrExistingUserAddingNoEmail(t *testing.T) {
+	tests := []struct {
+		rule  string
+		teams []string
+	}{
+		{"", []string{"eng", "pillarteam"}},
+		{NO_EMAIL_RULE_DEFAULT, []string{"eng", "pillarteam"}},
+		{NO_EMAIL_RULE_SKIP, nil},
+		{"integrations", []string{"eng"}},
+		{"unknown", []string{"eng", "pillarteam"}},
+	}
+
+	for _, test := range tests {
+		fake := setupAutoadd(t)
+		p := *Config()
+		p.NoEmailRule = test.rule
+		p.RuleSets = map[string]map[string][]string{
+			"integrations": {"eng": {"builds"}},
+		}
+		withConfig(t, &p)
+		fake.addUser(&model.User{Id: "ci", Username: "ci"})
+		ForgetProcessedUser("ci")
+
+		teams := HandleNewUserOrExistingUserAdding("ci")
+		sort.Strings(teams)
+		if !reflect.DeepEqual(teams, test.teams) {
+			t.Errorf("noemailrule %q: added to %v, expected %v", test.rule, teams, test.teams)
+		}
+	}
+}
+
+func TestHandleNewUserOrExistingUserAddingGuests(t *testing.T) {
+	fake := setupAutoadd(t)
+	fake.addUser(&model.User{Id: "visitor", Username: "visitor", Email: "visitor@partner.com", Roles: "system_guest"})
+
+	// Guests get nothing until guestautoadd is set
+	if teams := HandleNewUserOrExistingUserAdding("visitor"); teams != nil {
+		t.Errorf("a guest was added to %v without guestautoadd", teams)
+	}
+
+	p := *Config()
+	p.GuestAutoadd = map[string][]string{"pillarteam": {"off-topic"}}
+	withConfig(t, &p)
+	ForgetProcessedUser("visitor")
+
+	// pillarteam is all-except in autoadd, guests only join what's listed
+	teams := HandleNewUserOrExistingUserAdding("visitor")
+	if expected := []string{"pillarteam"}; !reflect.DeepEqual(teams, expected) {
+		t.Errorf("the guest was added to %v, expected %v", teams, expected)
+	}
+	expected := []string{"AddChannelMember pillarteam-off-topic visitor"}
+	if calls := fake.sortedCalls("AddChannelMember"); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("guest channel adds %q, expected %q", calls, expected)
+	}
+
+	teams = HandleNewUserOrExistingUserAdding("jane")
+	sort.Strings(teams)
+	if expected := []string{"eng", "pillarteam"}; !reflect.DeepEqual(teams, expected) {
+		t.Errorf("a regular user was added to %v, expected %v", teams, expected)
+	}
+	if fake.channelMembers["pillarteam-off-topic"]["jane"] != "" {
+		t.Error("the regular user got the guest rules")
+	}
+}
+
+func TestChannelsToJoin(t *testing.T) {
+	fake := setupAutoadd(t)
+	pillar := fake.teams["team-pillarteam"]
+	fake.addChannel(pillar, "announcements", model.CHANNEL_OPEN)
+	fake.addChannel(pillar, "Hiring", model.CHANNEL_OPEN)
+
+	channels, err := ChannelsToJoin(pillar, "pillarteam", []string{"off-topic", "hiring", CHANNEL_ID_PREFIX + "pillarteam-random"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(channels)
+	if expected := []string{"announcements", "town-square"}; !reflect.DeepEqual(channels, expected) {
+		t.Errorf("got %q, expected %q", channels, expected)
+	}
+	for _, channel := range channels {
+		if channel == "" {
+			t.Errorf("got an empty channel name in %q", channels)
+		}
+	}
+
+	// Only-listed teams join exactly what the rule lists
+	rule := []string{"builds"}
+	if channels, _ := ChannelsToJoin(fake.teams["team-eng"], "eng", rule); !reflect.DeepEqual(channels, rule) {
+		t.Errorf("got %q for eng, expected %q", channels, rule)
+	}
+}
+
+func TestAddUserToTeamTriesEveryChannel(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.Concurrency = 2
+	withConfig(t, &p)
+
+	team := fake.teams["team-eng"]
+	var rule, expected []string
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		fake.addChannel(team, name, model.CHANNEL_OPEN)
+		rule = append(rule, name)
+		if name == "b" || name == "e" || name == "f" {
+			fake.failOn("AddChannelMember eng-"+name+" jane", http.StatusForbidden)
+		} else {
+			expected = append(expected, name)
+		}
+	}
+
+	joined, ok := AddUserToTeam("jane", team.Id, "eng", rule, team)
+	if !ok {
+		t.Fatal("the team add failed")
+	}
+	sort.Strings(joined)
+	if !reflect.DeepEqual(joined, expected) {
+		t.Errorf("joined %v, expected %v", joined, expected)
+	}
+	if calls := fake.called("AddChannelMember"); len(calls) != len(rule) {
+		t.Errorf("attempted %d of the %d channels: %q", len(calls), len(rule), calls)
+	}
+}
+
+func TestHandleNewUserOrExistingUserAddingCooldown(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.AutoaddCooldown = time.Hour
+	withConfig(t, &p)
+	ResetProcessedUsers()
+	t.Cleanup(ResetProcessedUsers)
+
+	// What a join post and an add post for the same user both end up calling
+	join := &model.Post{UserId: "jane", Type: model.POST_JOIN_CHANNEL}
+	add := &model.Post{UserId: "admin", Type: model.POST_ADD_TO_CHANNEL, Props: model.StringInterface{"addedUserId": "jane"}}
+	var results [][]string
+	for _, post := range []*model.Post{join, add} {
+		results = append(results, HandleNewUserOrExistingUserAdding(JoinedUserId(post)))
+	}
+
+	if results[0] == nil || results[1] != nil {
+		t.Errorf("got %v, expected only the first event to add jane", results)
+	}
+	if calls := fake.called("GetUser jane", "AddTeamMember team-pillarteam jane"); len(calls) != 2 {
+		t.Errorf("autoadd ran more than once within the cooldown: %q", calls)
+	}
+
+	ForgetProcessedUser("jane")
+	if teams := HandleNewUserOrExistingUserAdding("jane"); teams == nil {
+		t.Error("jane was skipped after being forgotten")
+	}
+}
+
+func TestChannelInRule(t *testing.T) {
+	rule := []string{"Off-Topic", "town-square", "ENG-Builds"}
+	tests := []struct {
+		name  string
+		fold  bool
+		exact bool
+	}{
+		{"off-topic", true, false},
+		{"Off-Topic", true, true},
+		{"TOWN-SQUARE", true, false},
+		{"town-square", true, true},
+		{"eng-builds", true, false},
+		{"random", false, false},
+		{"off-topics", false, false},
+	}
+
+	withConfig(t, &Params{})
+	for _, test := range tests {
+		if ChannelInRule(test.name, rule) != test.fold {
+			t.Errorf("%q: expected a case-insensitive match to be %v", test.name, test.fold)
+		}
+	}
+
+	withConfig(t, &Params{ExactChannelNames: true})
+	for _, test := range tests {
+		if ChannelInRule(test.name, rule) != test.exact {
+			t.Errorf("%q: expected an exact match to be %v", test.name, test.exact)
+		}
+	}
+}
+
+func TestPublicChannelsPages(t *testing.T) {
+	for _, total := range []int{BACKFILL_PAGE_SIZE - 1, 2 * BACKFILL_PAGE_SIZE, 2*BACKFILL_PAGE_SIZE + 7} {
+		fake := setupAutoadd(t)
+		team := fake.addTeam("big")
+		for i := 0; i < total; i++ {
+			fake.addChannel(team, fmt.Sprintf("channel-%04d", i), model.CHANNEL_OPEN)
+		}
+
+		channels, calls, err := PublicChannels(team.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(channels) != total {
+			t.Errorf("%d channels: got %d", total, len(channels))
+		}
+		if pages := total/BACKFILL_PAGE_SIZE + 1; calls != pages || len(fake.called("GetPublicChannelsForTeam")) != pages {
+			t.Errorf("%d channels: took %d calls, expected %d", total, calls, pages)
+		}
+
+		seen := map[string]bool{}
+		for _, channel := range channels {
+			if seen[channel.Id] {
+				t.Errorf("%d channels: got %s twice", total, channel.Id)
+			}
+			seen[channel.Id] = true
+		}
+	}
+}
+
+func TestHandleNewUserOrExistingUserAddingSkipBots(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		fake := setupAutoadd(t)
+		p := *Config()
+		p.SkipBots = skip
+		withConfig(t, &p)
+		fake.addUser(&model.User{Id: "robot", Username: "robot"})
+		fake.addUser(&model.User{Id: "gone", Username: "gone", Email: "gone@example.com", DeleteAt: 1})
+		ForgetProcessedUser("robot")
+		ForgetProcessedUser("gone")
+
+		if teams := HandleNewUserOrExistingUserAdding("robot"); (teams == nil) != skip {
+			t.Errorf("skipbots %v: the bot account was added to %v", skip, teams)
+		}
+		if teams := HandleNewUserOrExistingUserAdding("gone"); teams != nil {
+			t.Errorf("skipbots %v: the deactivated user was added to %v", skip, teams)
+		}
+		if calls := fake.called("AddTeamMember team-eng gone", "AddTeamMember team-pillarteam gone"); len(calls) > 0 {
+			t.Errorf("skipbots %v: made %q for the deactivated user", skip, calls)
+		}
+	}
+}
+
+func TestSkipBotsAndNoEmailRule(t *testing.T) {
+	tests := []struct {
+		name          string
+		bot_usernames []string
+		ci            []string
+		robot         []string
+	}{
+		{"without botusernames skipbots wins over noemailrule", nil, nil, []string{"eng", "pillarteam"}},
+		{"with botusernames noemailrule applies", []string{"*-bot"}, []string{"eng"}, nil},
+	}
+
+	for _, test := range tests {
+		fake := setupAutoadd(t)
+		p := *Config()
+		p.SkipBots = true
+		p.BotUsernames = test.bot_usernames
+		p.NoEmailRule = "integrations"
+		p.RuleSets = map[string]map[string][]string{
+			"integrations": {"eng": {"builds"}},
+		}
+		withConfig(t, &p)
+		fake.addUser(&model.User{Id: "ci", Username: "ci"})
+		fake.addUser(&model.User{Id: "robot", Username: "robot-bot", Email: "robot@example.com"})
+		ForgetProcessedUser("ci")
+		ForgetProcessedUser("robot")
+
+		ci := HandleNewUserOrExistingUserAdding("ci")
+		robot := HandleNewUserOrExistingUserAdding("robot")
+		sort.Strings(ci)
+		sort.Strings(robot)
+		if !reflect.DeepEqual(ci, test.ci) {
+			t.Errorf("%s: the user without email was added to %v, expected %v", test.name, ci, test.ci)
+		}
+		if !reflect.DeepEqual(robot, test.robot) {
+			t.Errorf("%s: robot-bot was added to %v, expected %v", test.name, robot, test.robot)
+		}
+	}
+
+	if err := ValidateConfiguration(&Params{BotUsernames: []string{"bot-["}}); err == nil {
+		t.Error("a malformed botusernames pattern was accepted")
+	}
+}
+
+func TestNormalizeServer(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		server    string
+		use_tls   *bool
+		normal    string
+		api       string
+		websocket string
+	}{
+		{"mm.example.com", nil, "mm.example.com", "https://mm.example.com", "wss://mm.example.com"},
+		{"mm.example.com", &on, "mm.example.com", "https://mm.example.com", "wss://mm.example.com"},
+		{"mm.example.com", &off, "mm.example.com", "http://mm.example.com", "ws://mm.example.com"},
+		{"  mm.example.com/ ", nil, "mm.example.com", "https://mm.example.com", "wss://mm.example.com"},
+		{"http://mm.example.com", nil, "mm.example.com", "http://mm.example.com", "ws://mm.example.com"},
+		{"http://mm.example.com", &on, "mm.example.com", "http://mm.example.com", "ws://mm.example.com"},
+		{"HTTPS://mm.example.com/", &off, "mm.example.com", "https://mm.example.com", "wss://mm.example.com"},
+		{"mm.example.com:8065", nil, "mm.example.com:8065", "https://mm.example.com:8065", "wss://mm.example.com:8065"},
+		{"mm.example.com:8065", &off, "mm.example.com:8065", "http://mm.example.com:8065", "ws://mm.example.com:8065"},
+		{"https://mm.example.com:8443/chat/", nil, "mm.example.com:8443/chat", "https://mm.example.com:8443/chat", "wss://mm.example.com:8443/chat"},
+		{"10.0.0.5:8065/mattermost", nil, "10.0.0.5:8065/mattermost", "https://10.0.0.5:8065/mattermost", "wss://10.0.0.5:8065/mattermost"},
+	}
+
+	for _, test := range tests {
+		p := &Params{Server: test.server, UseTLS: test.use_tls}
+		if err := NormalizeServer(p); err != nil {
+			t.Errorf("%q: %v", test.server, err)
+			continue
+		}
+		if p.Server != test.normal {
+			t.Errorf("%q: normalized to %q, expected %q", test.server, p.Server, test.normal)
+		}
+		if api := serverURL(p); api != test.api {
+			t.Errorf("%q: got the API address %q, expected %q", test.server, api, test.api)
+		}
+		if websocket := webSocketURL(p); websocket != test.websocket {
+			t.Errorf("%q: got the websocket address %q, expected %q", test.server, websocket, test.websocket)
+		}
+
+		// Normalizing again changes nothing
+		again := *p
+		if err := NormalizeServer(&again); err != nil || again.Server != p.Server || serverURL(&again) != test.api {
+			t.Errorf("%q: normalizing twice gave %q", test.server, again.Server)
+		}
+	}
+
+	for _, server := range []string{"", "   ", "ftp://mm.example.com", "https://", "http://mm.example.com:port"} {
+		if err := NormalizeServer(&Params{Server: server}); err == nil {
+			t.Errorf("%q: expected an error", server)
+		}
+	}
+}
+
+func TestAddUserToTeamSkipsRefusedChannels(t *testing.T) {
+	fake := setupAutoadd(t)
+	fake.addUser(&model.User{Id: "joe", Username: "joe", Email: "joe@example.com"})
+	fake.failOn("AddChannelMember pillarteam-random jane", http.StatusForbidden)
+	fake.failOn("AddChannelMember pillarteam-town-square jane", http.StatusInternalServerError)
+	p := *Config()
+	p.MaxRetries = 1
+	p.Admins = []string{"jane"}
+	withConfig(t, &p)
+
+	team := fake.teams["team-pillarteam"]
+	rule := []string{"random", "town-square"}
+	AddUserToTeam("jane", team.Id, "pillarteam", rule, team)
+
+	// Only the 403 channel is skipped for the next user
+	joined, _ := AddUserToTeam("joe", team.Id, "pillarteam", rule, team)
+	if expected := []string{"town-square"}; !reflect.DeepEqual(joined, expected) {
+		t.Errorf("joe joined %v, expected %v", joined, expected)
+	}
+	if calls := fake.called("AddChannelMember pillarteam-random"); len(calls) != 1 {
+		t.Errorf("the refused channel was tried %d times, expected once: %q", len(calls), calls)
+	}
+
+	runCommand(t, fake, "jane", "!refreshchannels")
+	AddUserToTeam("joe", team.Id, "pillarteam", rule, team)
+	if calls := fake.called("AddChannelMember pillarteam-random joe"); len(calls) != 1 {
+		t.Errorf("the channel wasn't tried again after !refreshchannels: %q", calls)
+	}
+}
+
+func TestJoinMonitoredChannelRunsNoAutoadd(t *testing.T) {
+	fake := setupAutoadd(t)
+	lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+	fake.channelMembers[lobby.Id]["jane"] = model.CHANNEL_USER_ROLE_ID
+	p := *Config()
+	p.Channels = []string{"lobby"}
+	withConfig(t, &p)
+
+	old_team, old_channels := botTeam, monitoredChannels
+	botTeam, monitoredChannels = fake.teams["team-eng"], nil
+	t.Cleanup(func() { botTeam, monitoredChannels = old_team, old_channels })
+
+	// Without backfillonstart, joining leaves the channel's members alone
+	JoinMonitoredChannel()
+	if len(monitoredChannels) != 1 || monitoredChannels[0].Id != lobby.Id {
+		t.Errorf("monitoring %v, expected the lobby", monitoredChannels)
+	}
+	if calls := fake.called("GetUsersInChannel", "AddTeamMember", "AddChannelMember eng-builds"); len(calls) > 0 {
+		t.Errorf("joining the monitored channel ran autoadd: %q", calls)
+	}
+}
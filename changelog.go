@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// What caused the configuration to be loaded
+const (
+	CONFIG_TRIGGER_STARTUP = "startup"
+	CONFIG_TRIGGER_SIGHUP  = "SIGHUP"
+	CONFIG_TRIGGER_COMMAND = "!reload"
+	CONFIG_TRIGGER_TOKEN   = "!refreshtoken"
+)
+
+// ConfigChange is one load of the configuration and the keys it changed
+type ConfigChange struct {
+	At      time.Time
+	Trigger string
+	Changes []string
+}
+
+// Params fields whose values must never show up in a changelog: the
+// credentials, and the URLs and commands that can carry them in userinfo,
+// query strings or arguments
+var credentialFields = map[string]bool{
+	"Password":          true,
+	"Token":             true,
+	"HTTPProxy":         true,
+	"HTTPSProxy":        true,
+	"WebhookURL":        true,
+	"IdentityLookupURL": true,
+	"StartupHook":       true,
+}
+
+var changelogMutex sync.Mutex
+var configChangelog []ConfigChange
+
+// DiffParams describes every field that differs between two configs, using
+// the config.yaml key names. Credentials are only reported as changed.
+func DiffParams(old *Params, new *Params) []string {
+	var changes []string
+
+	oldValue := reflect.ValueOf(*old)
+	newValue := reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		before := oldValue.Field(i).Interface()
+		after := newValue.Field(i).Interface()
+
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+
+		key := strings.ToLower(field.Name)
+		if credentialFields[field.Name] {
+			changes = append(changes, key+" changed (value hidden)")
+		} else {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", key, displayValue(oldValue.Field(i)), displayValue(newValue.Field(i))))
+		}
+	}
+
+	return changes
+}
+
+// displayValue is the value of a Params field for the changelog, with
+// optional settings such as usetls shown by their value or as unset
+func displayValue(value reflect.Value) interface{} {
+	if value.Kind() != reflect.Ptr {
+		return value.Interface()
+	}
+	if value.IsNil() {
+		return "unset"
+	}
+
+	return value.Elem().Interface()
+}
+
+// RecordConfigChange adds an entry to the changelog for a config load
+func RecordConfigChange(trigger string, changes []string) {
+	changelogMutex.Lock()
+	defer changelogMutex.Unlock()
+
+	configChangelog = append(configChangelog, ConfigChange{At: time.Now(), Trigger: trigger, Changes: changes})
+}
+
+func HandleChangelogCommand(post *model.Post, args []string) {
+	changelogMutex.Lock()
+	defer changelogMutex.Unlock()
+
+	if len(configChangelog) == 0 {
+		ReplyToPost(post, "The configuration has not been loaded yet.")
+		return
+	}
+
+	msg := ""
+	for _, change := range configChangelog {
+		if change.Trigger == CONFIG_TRIGGER_STARTUP {
+			msg += fmt.Sprintf("**%s** loaded at startup\n", change.At.UTC().Format(time.RFC3339))
+			continue
+		}
+
+		msg += fmt.Sprintf("**%s** reloaded by %s", change.At.UTC().Format(time.RFC3339), change.Trigger)
+		if len(change.Changes) == 0 {
+			msg += ", nothing changed\n"
+			continue
+		}
+		msg += ":\n"
+		for _, line := range change.Changes {
+			msg += "- " + line + "\n"
+		}
+	}
+
+	ReplyToPost(post, msg)
+}
+
+// HandleConfigLoadedCommand tells when the configuration was last loaded and
+// what triggered it.
+func HandleConfigLoadedCommand(post *model.Post, args []string) {
+	changelogMutex.Lock()
+	defer changelogMutex.Unlock()
+
+	if len(configChangelog) == 0 {
+		ReplyToPost(post, "The configuration has not been loaded yet.")
+		return
+	}
+
+	last := configChangelog[len(configChangelog)-1]
+	ReplyToPost(post, fmt.Sprintf("The configuration was last loaded at %s (%s ago), triggered by %s.",
+		last.At.UTC().Format(time.RFC3339), time.Since(last.At).Round(time.Second), last.Trigger))
+}
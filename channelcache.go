@@ -0,0 +1,57 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+type channelEntry struct {
+	channel *model.Channel
+	fetched time.Time
+}
+
+var channelCacheMutex sync.Mutex
+var channelCache = map[string]channelEntry{}
+
+// CachedResolveChannel is ResolveChannel with the channels found kept for
+// params.ChannelCacheTTL, so adding many users in a row doesn't look every
+// channel up again for each of them. A TTL of 0 turns the cache off.
+func CachedResolveChannel(entry string, team_id string) (*model.Channel, *model.Response) {
+	ttl := Config().ChannelCacheTTL
+	if ttl <= 0 {
+		return ResolveChannel(entry, team_id)
+	}
+
+	key := team_id + "/" + entry
+
+	channelCacheMutex.Lock()
+	cached, ok := channelCache[key]
+	channelCacheMutex.Unlock()
+	if ok && time.Since(cached.fetched) < ttl {
+		return cached.channel, &model.Response{StatusCode: http.StatusOK}
+	}
+
+	channel, resp := ResolveChannel(entry, team_id)
+	if resp.Error != nil {
+		return channel, resp
+	}
+
+	channelCacheMutex.Lock()
+	channelCache[key] = channelEntry{channel: channel, fetched: time.Now()}
+	channelCacheMutex.Unlock()
+
+	return channel, resp
+}
+
+// ResetChannelCache forgets every cached channel
+func ResetChannelCache() {
+	channelCacheMutex.Lock()
+	channelCache = map[string]channelEntry{}
+	channelCacheMutex.Unlock()
+}
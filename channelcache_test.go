@@ -0,0 +1,60 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+func TestCachedResolveChannel(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.ChannelCacheTTL = time.Hour
+	withConfig(t, &p)
+	ResetChannelCache()
+	t.Cleanup(ResetChannelCache)
+
+	fake.addUser(&model.User{Id: "joe", Username: "joe", Email: "joe@example.com"})
+	team := fake.teams["team-eng"]
+	rule := []string{"builds", "town-square"}
+	for _, user := range []string{"jane", "joe", "jane"} {
+		if _, ok := AddUserToTeam(user, team.Id, "eng", rule, team); !ok {
+			t.Fatalf("adding %s failed", user)
+		}
+	}
+	if calls := fake.called("GetChannelByName"); len(calls) != len(rule) {
+		t.Errorf("three adds took %d lookups, expected one per channel: %q", len(calls), calls)
+	}
+
+	// Reloading the configuration empties the cache
+	ResetChannelCache()
+	AddUserToTeam("joe", team.Id, "eng", rule, team)
+	if calls := fake.called("GetChannelByName"); len(calls) != 2*len(rule) {
+		t.Errorf("got %d lookups after the reset, expected %d", len(calls), 2*len(rule))
+	}
+
+	// Lookups that fail aren't cached
+	for i := 0; i < 2; i++ {
+		CachedResolveChannel("missing", team.Id)
+	}
+	if calls := fake.called("GetChannelByName missing"); len(calls) != 2 {
+		t.Errorf("a failed lookup was cached: %q", calls)
+	}
+}
+
+func TestCachedResolveChannelDisabled(t *testing.T) {
+	fake := setupAutoadd(t)
+	ResetChannelCache()
+
+	team := fake.teams["team-eng"]
+	for i := 0; i < 3; i++ {
+		CachedResolveChannel("builds", team.Id)
+	}
+	if calls := fake.called("GetChannelByName"); len(calls) != 3 {
+		t.Errorf("got %d lookups without a channelcachettl, expected 3", len(calls))
+	}
+}
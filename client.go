@@ -0,0 +1,54 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"github.com/mattermost/platform/model"
+)
+
+// MattermostClient is the part of the server API the bot uses.
+// *model.Client4 implements it, and a fake one can stand in for the server
+// when trying code out.
+type MattermostClient interface {
+	Login(loginId string, password string) (*model.User, *model.Response)
+	SetOAuthToken(token string)
+	GetPing() (string, *model.Response)
+	GetOldClientConfig(etag string) (map[string]string, *model.Response)
+	GetSessions(userId, etag string) ([]*model.Session, *model.Response)
+
+	GetMe(etag string) (*model.User, *model.Response)
+	GetUser(userId, etag string) (*model.User, *model.Response)
+	GetUserByUsername(userName, etag string) (*model.User, *model.Response)
+	GetUsers(page int, perPage int, etag string) ([]*model.User, *model.Response)
+	GetUsersInTeam(teamId string, page int, perPage int, etag string) ([]*model.User, *model.Response)
+	GetUsersInChannel(channelId string, page int, perPage int, etag string) ([]*model.User, *model.Response)
+	UpdateUser(user *model.User) (*model.User, *model.Response)
+
+	GetTeamByName(name, etag string) (*model.Team, *model.Response)
+	GetTeamsForUser(userId, etag string) ([]*model.Team, *model.Response)
+	GetTeamMember(teamId, userId, etag string) (*model.TeamMember, *model.Response)
+	AddTeamMember(teamId, userId string) (*model.TeamMember, *model.Response)
+
+	GetChannel(channelId, etag string) (*model.Channel, *model.Response)
+	GetChannelByName(channelName, teamId string, etag string) (*model.Channel, *model.Response)
+	GetPublicChannelsForTeam(teamId string, page int, perPage int, etag string) ([]*model.Channel, *model.Response)
+	GetChannelsForTeamForUser(teamId, userId, etag string) ([]*model.Channel, *model.Response)
+	GetChannelStats(channelId string, etag string) (*model.ChannelStats, *model.Response)
+	CreateChannel(channel *model.Channel) (*model.Channel, *model.Response)
+	CreateDirectChannel(userId1, userId2 string) (*model.Channel, *model.Response)
+	GetChannelMember(channelId, userId, etag string) (*model.ChannelMember, *model.Response)
+	GetChannelMembers(channelId string, page, perPage int, etag string) (*model.ChannelMembers, *model.Response)
+	AddChannelMember(channelId, userId string) (*model.ChannelMember, *model.Response)
+	RemoveUserFromChannel(channelId, userId string) (bool, *model.Response)
+	UpdateChannelRoles(channelId, userId, roles string) (bool, *model.Response)
+
+	CreatePost(post *model.Post) (*model.Post, *model.Response)
+	DeletePost(postId string) (bool, *model.Response)
+}
+
+// client is what the bot talks to the server through. apiClient is the
+// real client behind it, for the token and transport the websocket and
+// proxies need.
+var client MattermostClient
+var apiClient *model.Client4
@@ -0,0 +1,637 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/platform/model"
+)
+
+// fakeClient stands in for the server in tests. It keeps the users, teams,
+// channels and memberships the server would have and records every call
+// made, as "<method> <argument>...", so tests can check what the bot did.
+type fakeClient struct {
+	mutex          sync.Mutex
+	calls          []string
+	failures       map[string]int
+	failuresLeft   map[string]int
+	users          map[string]*model.User
+	teams          map[string]*model.Team
+	channels       map[string]*model.Channel
+	teamMembers    map[string]map[string]bool
+	channelMembers map[string]map[string]string
+	posts          []*model.Post
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		failures:       map[string]int{},
+		failuresLeft:   map[string]int{},
+		users:          map[string]*model.User{},
+		teams:          map[string]*model.Team{},
+		channels:       map[string]*model.Channel{},
+		teamMembers:    map[string]map[string]bool{},
+		channelMembers: map[string]map[string]string{},
+	}
+}
+
+// withFakeClient makes a new fakeClient the bot's client, with the bot
+// logged in as the user "bot", for the rest of the test
+func withFakeClient(t *testing.T) *fakeClient {
+	fake := newFakeClient()
+	fake.addUser(&model.User{Id: "bot", Username: "bot", Email: "bot@example.com"})
+
+	old_client, old_bot := client, botUser
+	client, botUser = fake, fake.users["bot"]
+	t.Cleanup(func() {
+		client, botUser = old_client, old_bot
+	})
+
+	return fake
+}
+
+func (c *fakeClient) addUser(user *model.User) *model.User {
+	c.users[user.Id] = user
+	return user
+}
+
+// addTeam creates the team, with "team-<name>" as its id
+func (c *fakeClient) addTeam(name string) *model.Team {
+	team := &model.Team{Id: "team-" + name, Name: name, DisplayName: name}
+	c.teams[team.Id] = team
+	c.teamMembers[team.Id] = map[string]bool{}
+	return team
+}
+
+// addChannel creates the channel in the team, with "<team>-<name>" as its
+// id
+func (c *fakeClient) addChannel(team *model.Team, name string, channel_type string) *model.Channel {
+	channel := &model.Channel{Id: team.Name + "-" + name, TeamId: team.Id, Name: name, DisplayName: name, Type: channel_type}
+	c.channels[channel.Id] = channel
+	c.channelMembers[channel.Id] = map[string]string{}
+	return channel
+}
+
+// failOn makes the call, written as it is recorded, fail with status
+func (c *fakeClient) failOn(call string, status int) {
+	c.failures[call] = status
+}
+
+// failTimes makes the call fail with status the next times times, and then
+// succeed
+func (c *fakeClient) failTimes(call string, status int, times int) {
+	c.failures[call] = status
+	c.failuresLeft[call] = times
+}
+
+// record notes the call and returns the failure set up for it, if any. The
+// caller holds c.mutex.
+func (c *fakeClient) record(method string, args ...string) *model.Response {
+	call := strings.TrimSpace(method + " " + strings.Join(args, " "))
+	c.calls = append(c.calls, call)
+
+	status, ok := c.failures[call]
+	if !ok {
+		return nil
+	}
+	if left, limited := c.failuresLeft[call]; limited {
+		if left == 0 {
+			return nil
+		}
+		c.failuresLeft[call] = left - 1
+	}
+
+	return failed(method, status)
+}
+
+// called returns the recorded calls of the given methods, in order
+func (c *fakeClient) called(methods ...string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var calls []string
+	for _, call := range c.calls {
+		for _, method := range methods {
+			if strings.HasPrefix(call, method+" ") || call == method {
+				calls = append(calls, call)
+			}
+		}
+	}
+
+	return calls
+}
+
+// sortedCalls is called, sorted, for calls made by concurrent workers
+func (c *fakeClient) sortedCalls(methods ...string) []string {
+	calls := c.called(methods...)
+	sort.Strings(calls)
+	return calls
+}
+
+func succeeded() *model.Response {
+	return &model.Response{StatusCode: http.StatusOK}
+}
+
+func failed(where string, status int) *model.Response {
+	return &model.Response{
+		StatusCode: status,
+		Error:      model.NewAppError(where, "fake.error", nil, "status "+strconv.Itoa(status), status),
+	}
+}
+
+func (c *fakeClient) Login(loginId string, password string) (*model.User, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("Login", loginId); resp != nil {
+		return nil, resp
+	}
+	for _, user := range c.users {
+		if user.Email == loginId || user.Username == loginId {
+			return user, succeeded()
+		}
+	}
+
+	return nil, failed("Login", http.StatusUnauthorized)
+}
+
+func (c *fakeClient) SetOAuthToken(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.record("SetOAuthToken")
+}
+
+func (c *fakeClient) GetPing() (string, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetPing"); resp != nil {
+		return "", resp
+	}
+
+	return "OK", succeeded()
+}
+
+func (c *fakeClient) GetOldClientConfig(etag string) (map[string]string, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetOldClientConfig"); resp != nil {
+		return nil, resp
+	}
+
+	return map[string]string{"Version": "4.0.0"}, succeeded()
+}
+
+func (c *fakeClient) GetSessions(userId, etag string) ([]*model.Session, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetSessions", userId); resp != nil {
+		return nil, resp
+	}
+
+	return nil, succeeded()
+}
+
+func (c *fakeClient) GetMe(etag string) (*model.User, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetMe"); resp != nil {
+		return nil, resp
+	}
+
+	return c.users["bot"], succeeded()
+}
+
+func (c *fakeClient) GetUser(userId, etag string) (*model.User, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetUser", userId); resp != nil {
+		return nil, resp
+	}
+	if user, ok := c.users[userId]; ok {
+		return user, succeeded()
+	}
+
+	return nil, failed("GetUser", http.StatusNotFound)
+}
+
+func (c *fakeClient) GetUserByUsername(userName, etag string) (*model.User, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetUserByUsername", userName); resp != nil {
+		return nil, resp
+	}
+	for _, user := range c.users {
+		if user.Username == userName {
+			return user, succeeded()
+		}
+	}
+
+	return nil, failed("GetUserByUsername", http.StatusNotFound)
+}
+
+func (c *fakeClient) GetUsers(page int, perPage int, etag string) ([]*model.User, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetUsers", strconv.Itoa(page)); resp != nil {
+		return nil, resp
+	}
+
+	var ids []string
+	for id := range c.users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var users []*model.User
+	for _, id := range paged(ids, page, perPage) {
+		users = append(users, c.users[id])
+	}
+
+	return users, succeeded()
+}
+
+func (c *fakeClient) GetUsersInTeam(teamId string, page int, perPage int, etag string) ([]*model.User, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetUsersInTeam", teamId, strconv.Itoa(page)); resp != nil {
+		return nil, resp
+	}
+
+	var ids []string
+	for id := range c.teamMembers[teamId] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var users []*model.User
+	for _, id := range paged(ids, page, perPage) {
+		users = append(users, c.users[id])
+	}
+
+	return users, succeeded()
+}
+
+func (c *fakeClient) GetUsersInChannel(channelId string, page int, perPage int, etag string) ([]*model.User, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetUsersInChannel", channelId, strconv.Itoa(page)); resp != nil {
+		return nil, resp
+	}
+
+	var ids []string
+	for id := range c.channelMembers[channelId] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var users []*model.User
+	for _, id := range paged(ids, page, perPage) {
+		users = append(users, c.users[id])
+	}
+
+	return users, succeeded()
+}
+
+func (c *fakeClient) UpdateUser(user *model.User) (*model.User, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("UpdateUser", user.Id); resp != nil {
+		return nil, resp
+	}
+	c.users[user.Id] = user
+
+	return user, succeeded()
+}
+
+func (c *fakeClient) GetTeamByName(name, etag string) (*model.Team, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetTeamByName", name); resp != nil {
+		return nil, resp
+	}
+	for _, team := range c.teams {
+		if team.Name == name {
+			return team, succeeded()
+		}
+	}
+
+	return nil, failed("GetTeamByName", http.StatusNotFound)
+}
+
+func (c *fakeClient) GetTeamsForUser(userId, etag string) ([]*model.Team, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetTeamsForUser", userId); resp != nil {
+		return nil, resp
+	}
+
+	var teams []*model.Team
+	for id, members := range c.teamMembers {
+		if members[userId] {
+			teams = append(teams, c.teams[id])
+		}
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+
+	return teams, succeeded()
+}
+
+func (c *fakeClient) GetTeamMember(teamId, userId, etag string) (*model.TeamMember, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetTeamMember", teamId, userId); resp != nil {
+		return nil, resp
+	}
+	if !c.teamMembers[teamId][userId] {
+		return nil, failed("GetTeamMember", http.StatusNotFound)
+	}
+
+	return &model.TeamMember{TeamId: teamId, UserId: userId, Roles: "team_user"}, succeeded()
+}
+
+func (c *fakeClient) AddTeamMember(teamId, userId string) (*model.TeamMember, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("AddTeamMember", teamId, userId); resp != nil {
+		return nil, resp
+	}
+	if _, ok := c.teams[teamId]; !ok {
+		return nil, failed("AddTeamMember", http.StatusNotFound)
+	}
+	c.teamMembers[teamId][userId] = true
+
+	return &model.TeamMember{TeamId: teamId, UserId: userId, Roles: "team_user"}, succeeded()
+}
+
+func (c *fakeClient) GetChannel(channelId, etag string) (*model.Channel, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetChannel", channelId); resp != nil {
+		return nil, resp
+	}
+	if channel, ok := c.channels[channelId]; ok {
+		return channel, succeeded()
+	}
+
+	return nil, failed("GetChannel", http.StatusNotFound)
+}
+
+func (c *fakeClient) GetChannelByName(channelName, teamId string, etag string) (*model.Channel, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetChannelByName", channelName, teamId); resp != nil {
+		return nil, resp
+	}
+	for _, channel := range c.channels {
+		if channel.TeamId == teamId && channel.Name == channelName {
+			return channel, succeeded()
+		}
+	}
+
+	return nil, failed("GetChannelByName", http.StatusNotFound)
+}
+
+func (c *fakeClient) GetPublicChannelsForTeam(teamId string, page int, perPage int, etag string) ([]*model.Channel, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetPublicChannelsForTeam", teamId, strconv.Itoa(page)); resp != nil {
+		return nil, resp
+	}
+
+	var ids []string
+	for id, channel := range c.channels {
+		if channel.TeamId == teamId && channel.Type == model.CHANNEL_OPEN {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var channels []*model.Channel
+	for _, id := range paged(ids, page, perPage) {
+		channels = append(channels, c.channels[id])
+	}
+
+	return channels, succeeded()
+}
+
+func (c *fakeClient) GetChannelsForTeamForUser(teamId, userId, etag string) ([]*model.Channel, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetChannelsForTeamForUser", teamId, userId); resp != nil {
+		return nil, resp
+	}
+
+	var channels []*model.Channel
+	for id, channel := range c.channels {
+		if _, ok := c.channelMembers[id][userId]; ok && channel.TeamId == teamId {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+
+	return channels, succeeded()
+}
+
+func (c *fakeClient) GetChannelStats(channelId string, etag string) (*model.ChannelStats, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetChannelStats", channelId); resp != nil {
+		return nil, resp
+	}
+
+	return &model.ChannelStats{ChannelId: channelId, MemberCount: int64(len(c.channelMembers[channelId]))}, succeeded()
+}
+
+func (c *fakeClient) CreateChannel(channel *model.Channel) (*model.Channel, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("CreateChannel", channel.TeamId, channel.Name); resp != nil {
+		return nil, resp
+	}
+
+	created := *channel
+	created.Id = strings.TrimPrefix(channel.TeamId, "team-") + "-" + channel.Name
+	c.channels[created.Id] = &created
+	c.channelMembers[created.Id] = map[string]string{}
+
+	return &created, succeeded()
+}
+
+func (c *fakeClient) CreateDirectChannel(userId1, userId2 string) (*model.Channel, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("CreateDirectChannel", userId1, userId2); resp != nil {
+		return nil, resp
+	}
+
+	id := "dm-" + userId1 + "-" + userId2
+	if _, ok := c.channels[id]; !ok {
+		c.channels[id] = &model.Channel{Id: id, Name: userId1 + "__" + userId2, Type: model.CHANNEL_DIRECT}
+		c.channelMembers[id] = map[string]string{userId1: model.CHANNEL_USER_ROLE_ID, userId2: model.CHANNEL_USER_ROLE_ID}
+	}
+
+	return c.channels[id], succeeded()
+}
+
+func (c *fakeClient) GetChannelMember(channelId, userId, etag string) (*model.ChannelMember, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetChannelMember", channelId, userId); resp != nil {
+		return nil, resp
+	}
+	roles, ok := c.channelMembers[channelId][userId]
+	if !ok {
+		return nil, failed("GetChannelMember", http.StatusNotFound)
+	}
+
+	return &model.ChannelMember{ChannelId: channelId, UserId: userId, Roles: roles}, succeeded()
+}
+
+func (c *fakeClient) GetChannelMembers(channelId string, page, perPage int, etag string) (*model.ChannelMembers, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("GetChannelMembers", channelId, strconv.Itoa(page)); resp != nil {
+		return nil, resp
+	}
+
+	var ids []string
+	for id := range c.channelMembers[channelId] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	members := model.ChannelMembers{}
+	for _, id := range paged(ids, page, perPage) {
+		members = append(members, model.ChannelMember{ChannelId: channelId, UserId: id, Roles: c.channelMembers[channelId][id]})
+	}
+
+	return &members, succeeded()
+}
+
+func (c *fakeClient) AddChannelMember(channelId, userId string) (*model.ChannelMember, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("AddChannelMember", channelId, userId); resp != nil {
+		return nil, resp
+	}
+	if _, ok := c.channels[channelId]; !ok {
+		return nil, failed("AddChannelMember", http.StatusNotFound)
+	}
+	c.channelMembers[channelId][userId] = model.CHANNEL_USER_ROLE_ID
+
+	return &model.ChannelMember{ChannelId: channelId, UserId: userId, Roles: model.CHANNEL_USER_ROLE_ID}, succeeded()
+}
+
+func (c *fakeClient) RemoveUserFromChannel(channelId, userId string) (bool, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("RemoveUserFromChannel", channelId, userId); resp != nil {
+		return false, resp
+	}
+	delete(c.channelMembers[channelId], userId)
+
+	return true, succeeded()
+}
+
+func (c *fakeClient) UpdateChannelRoles(channelId, userId, roles string) (bool, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("UpdateChannelRoles", channelId, userId, roles); resp != nil {
+		return false, resp
+	}
+	if _, ok := c.channelMembers[channelId][userId]; !ok {
+		return false, failed("UpdateChannelRoles", http.StatusNotFound)
+	}
+	c.channelMembers[channelId][userId] = roles
+
+	return true, succeeded()
+}
+
+func (c *fakeClient) CreatePost(post *model.Post) (*model.Post, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("CreatePost", post.ChannelId); resp != nil {
+		return nil, resp
+	}
+
+	created := *post
+	created.Id = "post-" + strconv.Itoa(len(c.posts)+1)
+	c.posts = append(c.posts, &created)
+
+	return &created, succeeded()
+}
+
+func (c *fakeClient) DeletePost(postId string) (bool, *model.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resp := c.record("DeletePost", postId); resp != nil {
+		return false, resp
+	}
+
+	return true, succeeded()
+}
+
+// postsTo returns the messages posted to the channel
+func (c *fakeClient) postsTo(channel_id string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var messages []string
+	for _, post := range c.posts {
+		if post.ChannelId == channel_id {
+			messages = append(messages, post.Message)
+		}
+	}
+
+	return messages
+}
+
+// paged returns page number page of ids, perPage at a time
+func paged(ids []string, page int, perPage int) []string {
+	start := page * perPage
+	if start >= len(ids) {
+		return nil
+	}
+	end := start + perPage
+	if end > len(ids) {
+		end = len(ids)
+	}
+
+	return ids[start:end]
+}
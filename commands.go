@@ -0,0 +1,524 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	DEFAULT_COMMAND_PREFIX = "!"
+)
+
+// CommandPrefix starts every command, params.CommandPrefix or
+// DEFAULT_COMMAND_PREFIX.
+func CommandPrefix() string {
+	if Config().CommandPrefix == "" {
+		return DEFAULT_COMMAND_PREFIX
+	}
+
+	return Config().CommandPrefix
+}
+
+type Command struct {
+	AdminOnly bool
+	Handler   func(post *model.Post, args []string)
+}
+
+var commands map[string]Command
+
+// Commands are registered in init, as several handlers end up calling
+// HandleCommand again through the websocket handling.
+func init() {
+	commands = map[string]Command{
+		"tasks":           {AdminOnly: true, Handler: HandleTasksCommand},
+		"syncteam":        {AdminOnly: true, Handler: HandleSyncTeamCommand},
+		"cancel":          {AdminOnly: true, Handler: HandleCancelCommand},
+		"lastadd":         {Handler: HandleLastAddCommand},
+		"lint":            {Handler: HandleLintCommand},
+		"modes":           {Handler: HandleModesCommand},
+		"excluded":        {Handler: HandleExcludedCommand},
+		"latency":         {Handler: HandleLatencyCommand},
+		"monitored":       {Handler: HandleMonitoredCommand},
+		"eventstats":      {Handler: HandleEventStatsCommand},
+		"status":          {Handler: HandleStatusCommand},
+		"slowest":         {Handler: HandleSlowestCommand},
+		"whoami":          {Handler: HandleWhoamiCommand},
+		"channels":        {Handler: HandleChannelsCommand},
+		"workers":         {Handler: HandleWorkersCommand},
+		"teamsof":         {Handler: HandleTeamsOfCommand},
+		"configloaded":    {Handler: HandleConfigLoadedCommand},
+		"resolve":         {Handler: HandleResolveCommand},
+		"pending":         {Handler: HandlePendingCommand},
+		"whatif":          {Handler: HandleWhatifCommand},
+		"refreshtoken":    {AdminOnly: true, Handler: HandleRefreshTokenCommand},
+		"burst":           {AdminOnly: true, Handler: HandleBurstCommand},
+		"tokeninfo":       {AdminOnly: true, Handler: HandleTokenInfoCommand},
+		"whois":           {AdminOnly: true, Handler: HandleWhoisCommand},
+		"drain":           {AdminOnly: true, Handler: HandleDrainCommand},
+		"resume":          {AdminOnly: true, Handler: HandleResumeCommand},
+		"changelog":       {AdminOnly: true, Handler: HandleChangelogCommand},
+		"reload":          {AdminOnly: true, Handler: HandleReloadCommand},
+		"reset":           {AdminOnly: true, Handler: HandleResetCommand},
+		"testadd":         {AdminOnly: true, Handler: HandleTestAddCommand},
+		"autoadd":         {AdminOnly: true, Handler: HandleAutoaddCommand},
+		"syncstate":       {AdminOnly: true, Handler: HandleSyncStateCommand},
+		"refreshchannels": {AdminOnly: true, Handler: HandleRefreshChannelsCommand},
+	}
+}
+
+// HandleCommand runs the command contained in post, if any. It returns
+// false when the post is not addressed to the bot.
+func HandleCommand(post *model.Post) bool {
+	prefix := CommandPrefix()
+	if !strings.HasPrefix(post.Message, prefix) {
+		return false
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(post.Message, prefix))
+	if len(fields) == 0 {
+		return false
+	}
+
+	command, ok := commands[strings.ToLower(fields[0])]
+	if !ok {
+		return false
+	}
+
+	if command.AdminOnly && !IsAdmin(post.UserId) {
+		ReplyToPost(post, "Sorry, only bot admins can use `"+CommandPrefix()+fields[0]+"`.")
+		return true
+	}
+
+	command.Handler(post, fields[1:])
+	return true
+}
+
+// IsAdmin reports whether the user is listed in params.Admins, either by
+// id or by username.
+func IsAdmin(user_id string) bool {
+	if in_array(user_id, Config().Admins) {
+		return true
+	}
+
+	user, resp := client.GetUser(user_id, "")
+	if resp.Error != nil {
+		PrintError("We failed to look up user", resp.Error, "user_id", user_id)
+		return false
+	}
+
+	return in_array(user.Username, Config().Admins)
+}
+
+// ReplyToPost answers in the thread of the given post, splitting long
+// answers over several posts.
+func ReplyToPost(post *model.Post, msg string) {
+	for _, part := range SplitMessage(msg, MaxPostLength()) {
+		reply := &model.Post{}
+		reply.ChannelId = post.ChannelId
+		reply.Message = part
+
+		reply.RootId = post.Id
+		if post.RootId != "" {
+			reply.RootId = post.RootId
+		}
+
+		if _, resp := client.CreatePost(reply); resp.Error != nil {
+			PrintError("We failed to reply to post", resp.Error, "post_id", post.Id)
+			return
+		}
+	}
+}
+
+func HandleTasksCommand(post *model.Post, args []string) {
+	tasks := ListTasks()
+	if len(tasks) == 0 {
+		ReplyToPost(post, "No background tasks are registered.")
+		return
+	}
+
+	msg := "| Task | Status | Last activity |\n|---|---|---|\n"
+	for _, task := range tasks {
+		status := "running"
+		if !task.Running {
+			status = "stopped"
+		}
+		msg += fmt.Sprintf("| %s | %s | %s ago |\n", task.Name, status, time.Since(task.LastActivity).Round(time.Second))
+	}
+
+	ReplyToPost(post, msg)
+}
+
+func HandleModesCommand(post *model.Post, args []string) {
+	teams := make([]string, 0, len(Config().Autoadd))
+	for team_name := range Config().Autoadd {
+		teams = append(teams, team_name)
+	}
+	sort.Strings(teams)
+
+	msg := "| Team | Mode | Channels | Excluded |\n|---|---|---|---|\n"
+	for _, team_name := range teams {
+		mode := AutoaddMode(team_name)
+		count := len(Config().Autoadd[team_name])
+
+		if mode == AUTOADD_MODE_ALL_EXCEPT {
+			msg += fmt.Sprintf("| %s | %s | all public | %d |\n", team_name, mode, count)
+		} else {
+			msg += fmt.Sprintf("| %s | %s | %d | - |\n", team_name, mode, count)
+		}
+	}
+
+	ReplyToPost(post, msg)
+}
+
+// HandleExcludedCommand lists the public channels of a team that a new
+// user would not be added to under the team's autoadd rule.
+func HandleExcludedCommand(post *model.Post, args []string) {
+	if len(args) == 0 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"excluded <team>`")
+		return
+	}
+
+	team_name := args[0]
+	rule, ok := Config().Autoadd[team_name]
+	if !ok {
+		ReplyToPost(post, "There is no autoadd rule for team `"+team_name+"`.")
+		return
+	}
+
+	team, resp := client.GetTeamByName(team_name, "")
+	if resp.Error != nil {
+		ReplyToPost(post, "Could not find team `"+team_name+"`.")
+		PrintError("Could not find team", resp.Error, "team", team_name)
+		return
+	}
+
+	channels, err := ChannelsToJoin(team, team_name, rule)
+	if err != nil {
+		ReplyToPost(post, "Could not work out the channels of `"+team_name+"`: "+err.Message)
+		return
+	}
+
+	allChannel, _, err := PublicChannels(team.Id)
+	if err != nil {
+		ReplyToPost(post, "Could not list the public channels of `"+team_name+"`: "+err.Message)
+		return
+	}
+
+	var excluded []string
+	for _, channel := range allChannel {
+		if !ChannelInRule(channel.Name, channels) {
+			excluded = append(excluded, channel.Name)
+		}
+	}
+
+	if len(excluded) == 0 {
+		ReplyToPost(post, "New users of `"+team_name+"` ("+AutoaddMode(team_name)+") are added to every public channel.")
+		return
+	}
+
+	ReplyToPost(post, "New users of `"+team_name+"` ("+AutoaddMode(team_name)+") are not added to:\n- "+strings.Join(excluded, "\n- "))
+}
+
+// HandleMonitoredCommand lists the channels the bot watches for new users
+// and whether it is actually a member of them.
+func HandleMonitoredCommand(post *model.Post, args []string) {
+	msg := "| Channel | Id | Bot is member |\n|---|---|---|\n"
+	for _, name := range MonitoredChannelNames() {
+		var channel *model.Channel
+		for _, monitored := range monitoredChannels {
+			if monitored.Name == name {
+				channel = monitored
+			}
+		}
+		if channel == nil {
+			msg += fmt.Sprintf("| %s | not found, not watched | |\n", name)
+			continue
+		}
+
+		member := "yes"
+		if _, resp := client.GetChannelMember(channel.Id, botUser.Id, ""); resp.Error != nil {
+			member = "**no**"
+		}
+		msg += fmt.Sprintf("| %s | %s | %s |\n", channel.Name, channel.Id, member)
+	}
+
+	ReplyToPost(post, msg)
+}
+
+// LookupUsername resolves a username given to a command, with or without
+// the leading @.
+func LookupUsername(username string) (*model.User, *model.AppError) {
+	user, resp := client.GetUserByUsername(strings.TrimPrefix(username, "@"), "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if user == nil {
+		return nil, model.NewAppError("LookupUsername", "user.not_found", nil, "username="+username, http.StatusNotFound)
+	}
+
+	return user, nil
+}
+
+// HandleWhoisCommand shows the profile data autoadd rules are evaluated
+// against. Usage: !whois <username>
+func HandleWhoisCommand(post *model.Post, args []string) {
+	if len(args) == 0 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"whois <username>`")
+		return
+	}
+
+	user, err := LookupUsername(args[0])
+	if err != nil {
+		ReplyToPost(post, "Could not find user `"+args[0]+"`.")
+		return
+	}
+
+	deactivated := "no"
+	if user.DeleteAt != 0 {
+		deactivated = "yes, " + time.Unix(0, user.DeleteAt*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+	}
+
+	var team_names []string
+	if teams, resp := client.GetTeamsForUser(user.Id, ""); resp.Error != nil {
+		team_names = append(team_names, "(could not be fetched: "+resp.Error.Message+")")
+	} else {
+		for _, team := range teams {
+			team_names = append(team_names, team.Name)
+		}
+	}
+
+	ReplyToPost(post, fmt.Sprintf("**@%s**\n- Id: `%s`\n- Email: %s\n- Nickname: %s\n- Roles: %s\n- Deactivated: %s\n- Teams: %s",
+		user.Username, user.Id, user.Email, user.Nickname, user.Roles, deactivated, strings.Join(team_names, ", ")))
+}
+
+// HandleWhoamiCommand shows the bot's own identity, the first thing to
+// check when adds fail on permissions.
+func HandleWhoamiCommand(post *model.Post, args []string) {
+	me, resp := client.GetMe("")
+	if resp.Error != nil {
+		ReplyToPost(post, "Could not fetch the bot's own user: "+resp.Error.Message)
+		return
+	}
+
+	var team_names []string
+	if teams, resp := client.GetTeamsForUser(me.Id, ""); resp.Error != nil {
+		team_names = append(team_names, "(could not be fetched: "+resp.Error.Message+")")
+	} else {
+		for _, team := range teams {
+			team_names = append(team_names, team.Name)
+		}
+	}
+
+	// The server API this bot is built against predates bot accounts, so
+	// the bot always runs as a regular user account.
+	ReplyToPost(post, fmt.Sprintf("**@%s**\n- Id: `%s`\n- Roles: %s\n- Account type: user account\n- Teams: %s",
+		me.Username, me.Id, me.Roles, strings.Join(team_names, ", ")))
+}
+
+// HandleChannelsCommand lists the channels a user is in, by team. Without
+// a username it lists those of whoever asked. Private channels of another
+// user are only listed for admins. Usage: !channels [username]
+func HandleChannelsCommand(post *model.Post, args []string) {
+	var user *model.User
+	var err *model.AppError
+	if len(args) > 0 {
+		user, err = LookupUsername(args[0])
+	} else {
+		var resp *model.Response
+		user, resp = client.GetUser(post.UserId, "")
+		err = resp.Error
+	}
+	if err != nil {
+		ReplyToPost(post, "Could not find the user: "+err.Message)
+		return
+	}
+
+	teams, resp := client.GetTeamsForUser(user.Id, "")
+	if resp.Error != nil {
+		ReplyToPost(post, "Could not fetch the teams of @"+user.Username+": "+resp.Error.Message)
+		return
+	}
+
+	show_private := user.Id == post.UserId || IsAdmin(post.UserId)
+
+	msg := "**@" + user.Username + "** is in:"
+	for _, team := range teams {
+		channels, resp := client.GetChannelsForTeamForUser(team.Id, user.Id, "")
+		if resp.Error != nil {
+			msg += "\n- " + team.Name + ": (could not be fetched: " + resp.Error.Message + ")"
+			continue
+		}
+
+		var names []string
+		for _, channel := range channels {
+			if channel.Type == model.CHANNEL_OPEN || (show_private && channel.Type == model.CHANNEL_PRIVATE) {
+				names = append(names, channel.Name)
+			}
+		}
+		sort.Strings(names)
+		msg += "\n- " + team.Name + ": " + listOrNone(names)
+	}
+
+	ReplyToPost(post, msg)
+}
+
+// HandleResetCommand clears the runtime counters and caches, as if the bot
+// had just started, without reconnecting. Usage: !reset confirm
+func HandleResetCommand(post *model.Post, args []string) {
+	resets := []struct {
+		name  string
+		reset func()
+	}{
+		{"event counts", ClearEventCounts},
+		{"latency samples", ResetLatency},
+		{"slowest adds", ResetSlowestAdds},
+		{"welcomed users", ResetWelcomedUsers},
+		{"identity lookups", ResetIdentityCache},
+		{"recently processed users", ResetProcessedUsers},
+		{"cached channels", ResetChannelCache},
+		{"summary counters", ResetSummary},
+		{"last successful add", ResetLastAdd},
+		{"channels the bot can't add members to", ResetChannelAccess},
+		{"mirrored channel ids", ResetMirrorChannelIds},
+		{"teams the bot is known to be in", ResetBotTeams},
+		{"error report limit", ResetErrorReports},
+	}
+
+	var names []string
+	for _, r := range resets {
+		names = append(names, r.name)
+	}
+
+	// Pending work and history are not counters, they are left alone
+	const kept = "Queued deferred adds and welcomes, running tasks and the configuration changelog are kept."
+
+	if len(args) == 0 || args[0] != "confirm" {
+		ReplyToPost(post, "This clears the "+strings.Join(names, ", ")+". "+kept+" Run `"+CommandPrefix()+"reset confirm` to proceed.")
+		return
+	}
+
+	for _, r := range resets {
+		r.reset()
+	}
+
+	logger.Info("Runtime counters and caches reset")
+	ReplyToPost(post, "Reset the "+strings.Join(names, ", ")+". "+kept)
+}
+
+// HandleResolveCommand shows the channel id every entry of a team's
+// autoadd rule resolves to. Usage: !resolve <team>
+func HandleResolveCommand(post *model.Post, args []string) {
+	if len(args) == 0 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"resolve <team>`")
+		return
+	}
+
+	team_name := args[0]
+	rule, ok := Config().Autoadd[team_name]
+	if !ok {
+		ReplyToPost(post, "There is no autoadd rule for team `"+team_name+"`.")
+		return
+	}
+
+	team, resp := client.GetTeamByName(team_name, "")
+	if resp.Error != nil {
+		ReplyToPost(post, "Could not find team `"+team_name+"`.")
+		return
+	}
+
+	if len(rule) == 0 {
+		ReplyToPost(post, "The rule for `"+team_name+"` lists no channels.")
+		return
+	}
+
+	msg := "Rule for `" + team_name + "` (" + AutoaddMode(team_name) + "):\n\n| Entry | Channel id |\n|---|---|\n"
+	for _, entry := range rule {
+		channel, resp := ResolveChannel(entry, team.Id)
+		if resp.Error != nil {
+			msg += fmt.Sprintf("| %s | **NOT FOUND** (%s) |\n", entry, resp.Error.Message)
+		} else {
+			msg += fmt.Sprintf("| %s | `%s` |\n", entry, channel.Id)
+		}
+	}
+
+	ReplyToPost(post, msg)
+}
+
+// HandleAutoaddCommand runs autoadd again for a user, e.g. one who joined
+// while the bot was down. The add runs off the websocket listener and the
+// result is posted when it is done. Usage: !autoadd @username
+func HandleAutoaddCommand(post *model.Post, args []string) {
+	if len(args) == 0 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"autoadd @username`")
+		return
+	}
+
+	user, err := LookupUsername(args[0])
+	if err != nil {
+		ReplyToPost(post, "Could not find user `"+args[0]+"`.")
+		return
+	}
+
+	ForgetProcessedUser(user.Id)
+
+	dispatch("autoadd-command", func() {
+		teams := HandleNewUserOrExistingUserAdding(user.Id)
+		if len(teams) == 0 {
+			ReplyToPost(post, "@"+user.Username+" was not added to any team, see the log for why.")
+			return
+		}
+
+		ReplyToPost(post, "Added @"+user.Username+" to "+strings.Join(teams, ", ")+".")
+	})
+}
+
+// HandleTestAddCommand adds one user to one channel outside the autoadd
+// rules and reports exactly what the server answered.
+// Usage: !testadd <username> <[team/]channel>
+func HandleTestAddCommand(post *model.Post, args []string) {
+	if len(args) < 2 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"testadd <username> <[team/]channel>`")
+		return
+	}
+
+	user, err := LookupUsername(args[0])
+	if err != nil {
+		ReplyToPost(post, "Could not find user `"+args[0]+"`.")
+		return
+	}
+
+	team := botTeam
+	channel_name := args[1]
+	if i := strings.Index(channel_name, "/"); i >= 0 {
+		var resp *model.Response
+		if team, resp = client.GetTeamByName(channel_name[:i], ""); resp.Error != nil {
+			ReplyToPost(post, "Could not find team `"+channel_name[:i]+"`.")
+			return
+		}
+		channel_name = channel_name[i+1:]
+	}
+
+	channel, resp := client.GetChannelByName(channel_name, team.Id, "")
+	if resp.Error != nil {
+		ReplyToPost(post, "Could not find channel `"+channel_name+"` in team "+team.Name+".")
+		return
+	}
+
+	member, err := AddUserToChannel(channel.Id, user.Id, ChannelRoles(team.Name, channel.Name))
+	if err != nil {
+		ReplyToPost(post, fmt.Sprintf("Adding @%s to %s/%s failed:\n- Status: %d\n- Id: `%s`\n- Message: %s\n- Details: %s\n- Request: `%s`",
+			user.Username, team.Name, channel.Name, err.StatusCode, err.Id, err.Message, err.DetailedError, err.RequestId))
+		return
+	}
+
+	ReplyToPost(post, fmt.Sprintf("Added @%s to %s/%s with roles `%s`.",
+		user.Username, team.Name, channel.Name, member.Roles))
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/platform/model"
+)
+
+// runCommand posts the message as the user in eng/random and returns the
+// bot's replies
+func runCommand(t *testing.T, fake *fakeClient, user_id string, message string) []string {
+	before := len(fake.postsTo("eng-random"))
+	if !HandleCommand(&model.Post{Id: "command", UserId: user_id, ChannelId: "eng-random", Message: message}) {
+		t.Fatalf("%q was not taken as a command", message)
+	}
+
+	return fake.postsTo("eng-random")[before:]
+}
+
+// runLongCommand is runCommand for commands that answer from the
+// background, waiting for the replies expected
+func runLongCommand(t *testing.T, fake *fakeClient, user_id string, message string, replies int) []string {
+	before := len(fake.postsTo("eng-random"))
+	if !HandleCommand(&model.Post{Id: "command", UserId: user_id, ChannelId: "eng-random", Message: message}) {
+		t.Fatalf("%q was not taken as a command", message)
+	}
+
+	waitFor(t, "the replies to "+message, func() bool {
+		return len(fake.postsTo("eng-random")) >= before+replies
+	})
+
+	return fake.postsTo("eng-random")[before:]
+}
+
+func TestHandleTestAddCommand(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.Admins = []string{"admin"}
+	withConfig(t, &p)
+	fake.addUser(&model.User{Id: "admin", Username: "admin", Email: "admin@example.com"})
+
+	old := botTeam
+	botTeam = fake.teams["team-eng"]
+	t.Cleanup(func() { botTeam = old })
+
+	tests := []struct {
+		name    string
+		user_id string
+		message string
+		reply   string
+	}{
+		{"not an admin", "jane", "!testadd jane builds", "Sorry, only bot admins can use `!testadd`."},
+		{"usage", "admin", "!testadd jane", "Usage: `!testadd <username> <[team/]channel>`"},
+		{"unknown user", "admin", "!testadd nobody builds", "Could not find user `nobody`."},
+		{"unknown channel", "admin", "!testadd jane nowhere", "Could not find channel `nowhere` in team eng."},
+		{"unknown team", "admin", "!testadd jane sales/builds", "Could not find team `sales`."},
+		{"bot team", "admin", "!testadd @jane builds", "Added @jane to eng/builds with roles `channel_user`."},
+		{"other team", "admin", "!testadd jane pillarteam/random", "Added @jane to pillarteam/random with roles `channel_user`."},
+	}
+
+	for _, test := range tests {
+		replies := runCommand(t, fake, test.user_id, test.message)
+		if len(replies) != 1 || replies[0] != test.reply {
+			t.Errorf("%s: replied %q, expected %q", test.name, replies, test.reply)
+		}
+	}
+	if fake.channelMembers["eng-builds"]["jane"] == "" || fake.channelMembers["pillarteam-random"]["jane"] == "" {
+		t.Error("the successful adds didn't reach the server")
+	}
+
+	fake.failOn("AddChannelMember eng-town-square jane", http.StatusForbidden)
+	replies := runCommand(t, fake, "admin", "!testadd jane town-square")
+	if len(replies) != 1 || !strings.HasPrefix(replies[0], "Adding @jane to eng/town-square failed:\n- Status: 403\n") {
+		t.Errorf("replied %q for a failed add, expected the server's answer", replies)
+	}
+}
+
+func TestHandleAutoaddCommand(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.Admins = []string{"root", "ops-id"}
+	p.Autoadd = map[string][]string{"eng": {"builds"}}
+	withConfig(t, &p)
+	fake.addUser(&model.User{Id: "root-id", Username: "root", Email: "root@example.com"})
+	fake.addUser(&model.User{Id: "ops-id", Username: "ops", Email: "ops@example.com"})
+
+	replies := runCommand(t, fake, "jane", "!autoadd @jane")
+	if expected := "Sorry, only bot admins can use `!autoadd`."; len(replies) != 1 || replies[0] != expected {
+		t.Errorf("replied %q to a non-admin, expected %q", replies, expected)
+	}
+	if calls := fake.called("AddTeamMember"); len(calls) > 0 {
+		t.Errorf("a non-admin triggered %q", calls)
+	}
+
+	tests := []struct {
+		name    string
+		user_id string
+		message string
+		reply   string
+	}{
+		{"usage", "root-id", "!autoadd", "Usage: `!autoadd @username`"},
+		{"unknown user", "root-id", "!autoadd @nobody", "Could not find user `@nobody`."},
+		{"admin by username", "root-id", "!autoadd @jane", "Added @jane to eng."},
+		{"admin by id, without the @", "ops-id", "!autoadd jane", "Added @jane to eng."},
+	}
+	for _, test := range tests {
+		replies := runLongCommand(t, fake, test.user_id, test.message, 1)
+		if len(replies) != 1 || replies[0] != test.reply {
+			t.Errorf("%s: replied %q, expected %q", test.name, replies, test.reply)
+		}
+	}
+	if calls := fake.called("AddTeamMember"); len(calls) != 2 {
+		t.Errorf("expected two runs for the admins, got %q", calls)
+	}
+}
+
+func TestHandleRefreshTokenCommandRereadsConfig(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.Admins = []string{"jane"}
+	withConfig(t, &p)
+
+	dir, err := ioutil.TempDir("", "refreshtoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := configPath
+	configPath = filepath.Join(dir, "config.yaml")
+	defer func() { configPath = old }()
+
+	if err := ioutil.WriteFile(configPath, []byte("loglevel: loud\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := runCommand(t, fake, "jane", "!refreshtoken")
+	if len(replies) != 1 || !strings.HasPrefix(replies[0], "The configuration is invalid, keeping the current connection: ") {
+		t.Errorf("replied %q to an invalid configuration", replies)
+	}
+	if calls := append(fake.called("Login"), fake.called("SetOAuthToken")...); len(calls) != 0 {
+		t.Errorf("logged in again with an invalid configuration: %q", calls)
+	}
+}
+
+func TestHandleResetCommandClearsState(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.Admins = []string{"jane"}
+	withConfig(t, &p)
+
+	RecordSuccessfulAdd()
+	CountDestination("eng", "builds")
+	RecordAddRefused(&model.Channel{Id: "locked", Name: "locked"}, "eng", model.NewAppError("test", "fake.error", nil, "", http.StatusForbidden))
+	mirrorMutex.Lock()
+	mirrorChannelIds["eng/builds"] = "builds"
+	mirrorMutex.Unlock()
+
+	replies := runCommand(t, fake, "jane", "!reset confirm")
+	if len(replies) != 1 || !strings.HasPrefix(replies[0], "Reset the ") {
+		t.Fatalf("replied %q", replies)
+	}
+
+	if _, ok := TimeSinceLastAdd(); ok {
+		t.Error("the last successful add was kept")
+	}
+	summaryMutex.Lock()
+	adds, destinations := summaryAdds, len(summaryDestinations)
+	summaryMutex.Unlock()
+	if adds != 0 || destinations != 0 {
+		t.Errorf("the summary counters were kept: %d adds, %d destinations", adds, destinations)
+	}
+	if !CanAddMembers(&model.Channel{Id: "locked"}) {
+		t.Error("the refused channel was kept")
+	}
+	mirrorMutex.Lock()
+	mirrored := len(mirrorChannelIds)
+	mirrorMutex.Unlock()
+	if mirrored != 0 {
+		t.Errorf("%d mirrored channel ids were kept", mirrored)
+	}
+}
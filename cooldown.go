@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	STATE_SAVE_INTERVAL = time.Minute
+)
+
+var processedMutex sync.Mutex
+var processedUsers = map[string]time.Time{}
+
+// RecentlyProcessed reports whether the user went through autoadd less
+// than params.AutoaddCooldown ago, and otherwise marks them as processed
+// now. Several events for one join then only add the user once.
+func RecentlyProcessed(user_id string) bool {
+	if Config().AutoaddCooldown <= 0 {
+		return false
+	}
+
+	processedMutex.Lock()
+	defer processedMutex.Unlock()
+
+	now := time.Now()
+	for id, at := range processedUsers {
+		if now.Sub(at) >= Config().AutoaddCooldown {
+			delete(processedUsers, id)
+		}
+	}
+
+	if _, ok := processedUsers[user_id]; ok {
+		return true
+	}
+	processedUsers[user_id] = now
+
+	return false
+}
+
+// ForgetProcessedUser lets the user through autoadd again right away
+func ForgetProcessedUser(user_id string) {
+	processedMutex.Lock()
+	delete(processedUsers, user_id)
+	processedMutex.Unlock()
+}
+
+// ResetProcessedUsers forgets which users were processed recently
+func ResetProcessedUsers() {
+	processedMutex.Lock()
+	processedUsers = map[string]time.Time{}
+	processedMutex.Unlock()
+}
+
+// PersistProcessedUsers loads the users processed within the cooldown by
+// a previous run from params.StateFile, so a restart doesn't add them all
+// again, and saves them there every STATE_SAVE_INTERVAL. Without a state
+// file they are only kept in memory.
+func PersistProcessedUsers() {
+	if Config().StateFile == "" {
+		return
+	}
+
+	loadProcessedUsers()
+
+	StartTask("state-file", func() {
+		ticker := time.NewTicker(STATE_SAVE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-shutdownCtx.Done():
+				return
+			case <-ticker.C:
+				TaskActivity("state-file")
+				SaveProcessedUsers()
+			}
+		}
+	})
+}
+
+func loadProcessedUsers() {
+	source, err := ioutil.ReadFile(Config().StateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+
+	loaded := map[string]time.Time{}
+	if err == nil {
+		err = json.Unmarshal(source, &loaded)
+	}
+	if err != nil {
+		logger.Error("We failed to load the state file", "path", Config().StateFile, "error", err)
+		return
+	}
+
+	processedMutex.Lock()
+	for id, at := range loaded {
+		processedUsers[id] = at
+	}
+	processedMutex.Unlock()
+
+	logger.Info("Loaded recently processed users", "path", Config().StateFile, "count", len(loaded))
+}
+
+// SaveProcessedUsers writes the recently processed users to
+// params.StateFile, if set, replacing it in one go.
+func SaveProcessedUsers() {
+	if Config().StateFile == "" {
+		return
+	}
+
+	processedMutex.Lock()
+	data, err := json.Marshal(processedUsers)
+	processedMutex.Unlock()
+
+	if err == nil {
+		tmp := Config().StateFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, Config().StateFile)
+		}
+	}
+	if err != nil {
+		logger.Error("We failed to save the state file", "path", Config().StateFile, "error", err)
+	}
+}
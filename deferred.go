@@ -0,0 +1,306 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	DEFERRED_CHECK_INTERVAL     = 30 * time.Second
+	DEFAULT_DEFERRED_QUEUE_FILE = "mattermost_bot.deferred.json"
+
+	DEFER_REASON_OFF_HOURS = "outside business hours"
+	DEFER_REASON_NEW_USER  = "new user delay"
+)
+
+// DeferredAdd is a user whose autoadd has been put off until At
+type DeferredAdd struct {
+	UserId string    `json:"user_id"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+var deferredMutex sync.Mutex
+var deferredAdds []DeferredAdd
+
+// AutoaddNewUser runs autoadd for a user who just showed up, or queues the
+// user for later when that is what the configuration asks for.
+func AutoaddNewUser(user_id string) {
+	if Config().BusinessHours != "" && !InBusinessHours(time.Now()) {
+		DeferAutoadd(user_id, DEFER_REASON_OFF_HOURS, NextBusinessHoursStart(time.Now()))
+		return
+	}
+
+	if Config().NewUserDelay > 0 {
+		delayAutoadd(user_id, Config().NewUserDelay)
+		return
+	}
+
+	HandleNewUserOrExistingUserAdding(user_id)
+}
+
+// delayAutoadd processes the user after delay plus up to a fifth of it
+// again as jitter, giving the server time to finish setting up the
+// account. Shutdown waits for it; should the bot stop first, the user is
+// queued with DeferAutoadd instead, which keeps them for the next run.
+func delayAutoadd(user_id string, delay time.Duration) {
+	delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+
+	if !beginWork() {
+		DeferAutoadd(user_id, DEFER_REASON_NEW_USER, time.Now().Add(delay))
+		return
+	}
+	go func() {
+		defer endWork()
+
+		select {
+		case <-time.After(delay):
+			HandleNewUserOrExistingUserAdding(user_id)
+		case <-shutdownCtx.Done():
+			DeferAutoadd(user_id, DEFER_REASON_NEW_USER, time.Now().Add(delay))
+		}
+	}()
+}
+
+// DeferAutoadd queues the user to be processed at the given time
+func DeferAutoadd(user_id string, reason string, at time.Time) {
+	deferredMutex.Lock()
+	defer deferredMutex.Unlock()
+
+	deferredAdds = append(deferredAdds, DeferredAdd{UserId: user_id, Reason: reason, At: at})
+	saveDeferredAdds()
+
+	logger.Info("Deferred autoadd", "user_id", user_id, "until", at, "reason", reason)
+}
+
+// PendingAdds returns a copy of the queued users
+func PendingAdds() []DeferredAdd {
+	deferredMutex.Lock()
+	defer deferredMutex.Unlock()
+
+	return append([]DeferredAdd(nil), deferredAdds...)
+}
+
+// HandlePendingCommand lists the queued autoadds, soonest first
+func HandlePendingCommand(post *model.Post, args []string) {
+	pending := PendingAdds()
+	if len(pending) == 0 {
+		ReplyToPost(post, "No autoadds are waiting.")
+		return
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].At.Before(pending[j].At) })
+
+	reasons := map[string]int{}
+	for _, add := range pending {
+		reasons[add.Reason]++
+	}
+
+	msg := fmt.Sprintf("%d autoadds are waiting, the next one in %s.\n", len(pending),
+		time.Until(pending[0].At).Round(time.Second))
+	for reason, count := range reasons {
+		msg += fmt.Sprintf("- %s: %d\n", reason, count)
+	}
+
+	msg += "\n| User | Reason | Scheduled |\n|---|---|---|\n"
+	for _, add := range pending {
+		msg += fmt.Sprintf("| %s | %s | %s |\n", add.UserId, add.Reason, add.At.Format(time.RFC3339))
+	}
+
+	ReplyToPost(post, msg)
+}
+
+// dueAdds returns the queued users whose time has come. They stay queued
+// until finishDeferredAdd, so a shutdown halfway through keeps the rest.
+func dueAdds(now time.Time) []DeferredAdd {
+	deferredMutex.Lock()
+	defer deferredMutex.Unlock()
+
+	var due []DeferredAdd
+	for _, add := range deferredAdds {
+		if !add.At.After(now) {
+			due = append(due, add)
+		}
+	}
+
+	return due
+}
+
+// finishDeferredAdd removes a processed user from the queue
+func finishDeferredAdd(done DeferredAdd) {
+	deferredMutex.Lock()
+	defer deferredMutex.Unlock()
+
+	for i, add := range deferredAdds {
+		if add.UserId == done.UserId && add.At.Equal(done.At) {
+			deferredAdds = append(deferredAdds[:i], deferredAdds[i+1:]...)
+			saveDeferredAdds()
+			return
+		}
+	}
+}
+
+// processDueAdds runs autoadd for the users due at now, stopping at
+// shutdown. A user whose add was cut short by the shutdown stays queued.
+func processDueAdds(now time.Time) {
+	for _, add := range dueAdds(now) {
+		if ShuttingDown() {
+			return
+		}
+
+		HandleNewUserOrExistingUserAdding(add.UserId)
+		if ShuttingDown() {
+			return
+		}
+		finishDeferredAdd(add)
+	}
+}
+
+// ProcessDeferredAdds loads the queue saved by a previous run and processes
+// queued users as they become due.
+func ProcessDeferredAdds() {
+	loadDeferredAdds()
+
+	StartTask("deferred-adds", func() {
+		for now := range time.Tick(DEFERRED_CHECK_INTERVAL) {
+			TaskActivity("deferred-adds")
+			if !IsLeader() {
+				continue
+			}
+
+			processDueAdds(now)
+		}
+	})
+}
+
+// deferredQueueFile is params.DeferredQueueFile or
+// DEFAULT_DEFERRED_QUEUE_FILE
+func deferredQueueFile() string {
+	if Config().DeferredQueueFile == "" {
+		return DEFAULT_DEFERRED_QUEUE_FILE
+	}
+
+	return Config().DeferredQueueFile
+}
+
+func loadDeferredAdds() {
+	source, err := ioutil.ReadFile(deferredQueueFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(source, &deferredAdds)
+	}
+	if err != nil {
+		logger.Error("We failed to load the deferred queue", "path", deferredQueueFile(), "error", err)
+		return
+	}
+
+	logger.Info("Loaded deferred autoadds", "path", deferredQueueFile(), "count", len(deferredAdds))
+}
+
+// saveDeferredAdds writes the queue to deferredQueueFile(). The caller must
+// hold deferredMutex.
+func saveDeferredAdds() {
+	path := deferredQueueFile()
+
+	data, err := json.Marshal(deferredAdds)
+	if err == nil {
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		logger.Error("We failed to save the deferred queue", "path", path, "error", err)
+	}
+}
+
+// parseBusinessHours splits params.BusinessHours, e.g. "09:00-17:00", into
+// minutes after midnight.
+func parseBusinessHours(hours string) (int, int, error) {
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("businesshours must look like 09:00-17:00")
+	}
+
+	start, err := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+// businessLocation returns params.BusinessTimezone, defaulting to UTC
+func businessLocation() *time.Location {
+	if location, err := time.LoadLocation(Config().BusinessTimezone); err == nil {
+		return location
+	}
+
+	return time.UTC
+}
+
+// ValidateBusinessHours checks the business hours settings
+func ValidateBusinessHours(p *Params) error {
+	if p.BusinessHours == "" {
+		return nil
+	}
+	if _, _, err := parseBusinessHours(p.BusinessHours); err != nil {
+		return err
+	}
+	_, err := time.LoadLocation(p.BusinessTimezone)
+
+	return err
+}
+
+// InBusinessHours reports whether now falls inside params.BusinessHours. A
+// start after the end, e.g. "22:00-06:00", is an overnight window.
+func InBusinessHours(now time.Time) bool {
+	start, end, err := parseBusinessHours(Config().BusinessHours)
+	if err != nil {
+		return true
+	}
+
+	local := now.In(businessLocation())
+	minute := local.Hour()*60 + local.Minute()
+
+	if start > end {
+		return minute >= start || minute < end
+	}
+
+	return minute >= start && minute < end
+}
+
+// NextBusinessHoursStart returns when business hours next begin after now
+func NextBusinessHoursStart(now time.Time) time.Time {
+	start, _, err := parseBusinessHours(Config().BusinessHours)
+	if err != nil {
+		return now
+	}
+
+	local := now.In(businessLocation())
+	next := time.Date(local.Year(), local.Month(), local.Day(), start/60, start%60, 0, 0, local.Location())
+	if !next.After(local) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next
+}
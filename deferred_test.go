@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInBusinessHours(t *testing.T) {
+	tests := []struct {
+		hours    string
+		at       string
+		expected bool
+	}{
+		{"09:00-17:00", "08:59", false},
+		{"09:00-17:00", "09:00", true},
+		{"09:00-17:00", "16:59", true},
+		{"09:00-17:00", "17:00", false},
+		{"22:00-06:00", "21:59", false},
+		{"22:00-06:00", "22:00", true},
+		{"22:00-06:00", "00:30", true},
+		{"22:00-06:00", "05:59", true},
+		{"22:00-06:00", "06:00", false},
+		{"22:00-06:00", "12:00", false},
+	}
+
+	for _, test := range tests {
+		withConfig(t, &Params{BusinessHours: test.hours, BusinessTimezone: "UTC"})
+
+		at, _ := time.Parse("15:04", test.at)
+		if got := InBusinessHours(at); got != test.expected {
+			t.Errorf("%s at %s: got %v, expected %v", test.hours, test.at, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	DRAIN_POLL_INTERVAL = time.Second
+)
+
+var draining int32
+var inFlightAdds int32
+
+// inFlightWork counts the adds and delayed adds shutdown waits for. It only
+// changes under inFlightMutex, which also sees that nothing new starts once
+// shutdown has begun, so WaitForAdds can't miss work started late.
+var inFlightMutex sync.Mutex
+var inFlightDone = sync.NewCond(&inFlightMutex)
+var inFlightWork int
+
+// shutdownCtx is cancelled when the bot is told to stop. Event handling and
+// bulk work stop taking on new users once it is done.
+var shutdownCtx, cancelShutdown = context.WithCancel(context.Background())
+
+// ShuttingDown reports whether shutdownCtx has been cancelled
+func ShuttingDown() bool {
+	return shutdownCtx.Err() != nil
+}
+
+// IsDraining reports whether new events are being turned away
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// beginWork counts work shutdown should wait for. Once shutdown has begun
+// it refuses, returning false, and the work must not start.
+func beginWork() bool {
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+
+	if ShuttingDown() {
+		return false
+	}
+	inFlightWork++
+
+	return true
+}
+
+func endWork() {
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+
+	inFlightWork--
+	if inFlightWork == 0 {
+		inFlightDone.Broadcast()
+	}
+}
+
+// beginAdd and endAdd bracket a user being processed by autoadd. beginAdd
+// returns false when shutdown has begun.
+func beginAdd() bool {
+	if !beginWork() {
+		return false
+	}
+	atomic.AddInt32(&inFlightAdds, 1)
+
+	return true
+}
+
+func endAdd() {
+	atomic.AddInt32(&inFlightAdds, -1)
+	endWork()
+}
+
+// WaitForAdds waits up to timeout for the users being processed to be
+// done, and reports whether they were. Shutdown must have begun, so that
+// no more work starts in the meantime.
+func WaitForAdds(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		inFlightMutex.Lock()
+		for inFlightWork > 0 {
+			inFlightDone.Wait()
+		}
+		inFlightMutex.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// InFlightAdds returns how many users are being processed right now
+func InFlightAdds() int {
+	return int(atomic.LoadInt32(&inFlightAdds))
+}
+
+// HandleDrainCommand stops taking on new events and reports back once the
+// work already in progress has finished.
+func HandleDrainCommand(post *model.Post, args []string) {
+	if !atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		ReplyToPost(post, "Already draining.")
+		return
+	}
+
+	logger.Info("Draining, new events are ignored until !resume")
+	ReplyToPost(post, fmt.Sprintf("Draining: new events are ignored, waiting for %d add(s) in progress.", InFlightAdds()))
+
+	StartTask("drain", func() {
+		for IsDraining() && InFlightAdds() > 0 {
+			TaskActivity("drain")
+			time.Sleep(DRAIN_POLL_INTERVAL)
+		}
+
+		if IsDraining() {
+			logger.Info("Drained, no work in progress")
+			ReplyToPost(post, "Drained, nothing is in progress. It is safe to shut down, or `"+CommandPrefix()+"resume` to carry on.")
+		}
+	})
+}
+
+func HandleResumeCommand(post *model.Post, args []string) {
+	if !atomic.CompareAndSwapInt32(&draining, 1, 0) {
+		ReplyToPost(post, "Not draining, nothing to resume.")
+		return
+	}
+
+	logger.Info("Resumed handling events")
+	ReplyToPost(post, "Resumed handling events.")
+}
+
+func HandleStatusCommand(post *model.Post, args []string) {
+	state := "running"
+	if IsDraining() {
+		state = "draining"
+		if InFlightAdds() == 0 {
+			state = "drained"
+		}
+	}
+
+	ReplyToPost(post, fmt.Sprintf("**%s** is %s.\n- Up for %s\n- Adds in progress: %d",
+		BOT_NAME, state, time.Since(startedAt).Round(time.Second), InFlightAdds()))
+}
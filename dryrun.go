@@ -0,0 +1,15 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+// DryRun reports whether params.DryRun is set, in which case it logs what
+// would have been done and the caller skips the change.
+func DryRun(action string, args ...interface{}) bool {
+	if !Config().DryRun {
+		return false
+	}
+
+	logger.Info("dry run, would "+action, args...)
+	return true
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDryRunMakesNoChanges(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.DryRun = true
+	p.CreateMissingChannels = true
+	p.Autoadd = map[string][]string{
+		"eng":        {"builds", "announcements"},
+		"pillarteam": {"off-topic"},
+	}
+	withConfig(t, &p)
+
+	teams := HandleNewUserOrExistingUserAdding("jane")
+	sort.Strings(teams)
+	if expected := []string{"eng", "pillarteam"}; !reflect.DeepEqual(teams, expected) {
+		t.Errorf("a dry run reported %v, expected %v", teams, expected)
+	}
+
+	if calls := fake.called("AddTeamMember", "AddChannelMember", "UpdateChannelRoles", "CreateChannel"); len(calls) > 0 {
+		t.Errorf("a dry run changed the server: %q", calls)
+	}
+	for team_id, members := range fake.teamMembers {
+		if members["jane"] {
+			t.Errorf("a dry run added jane to %s", team_id)
+		}
+	}
+	if fake.channels["eng-announcements"] != nil {
+		t.Error("a dry run created the missing channel")
+	}
+}
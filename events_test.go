@@ -0,0 +1,206 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// postedEvent is a posted event as the server sends it, with the post
+// encoded as JSON in its data
+func postedEvent(post *model.Post) *model.WebSocketEvent {
+	return &model.WebSocketEvent{
+		Event: model.WEBSOCKET_EVENT_POSTED,
+		Data:  map[string]interface{}{"post": post.ToJson()},
+	}
+}
+
+// withMonitoredChannel makes the channel the one watched for new users for
+// the rest of the test
+func withMonitoredChannel(t *testing.T, channel *model.Channel) {
+	old := monitoredChannels
+	monitoredChannels = []*model.Channel{channel}
+	t.Cleanup(func() { monitoredChannels = old })
+}
+
+func TestHandleMsgFromMonitoredChannelJoin(t *testing.T) {
+	fake := setupAutoadd(t)
+	lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+	withMonitoredChannel(t, lobby)
+
+	HandleMsgFromMonitoredChannel(postedEvent(&model.Post{
+		Id:        "join-post",
+		UserId:    "jane",
+		ChannelId: lobby.Id,
+		Type:      model.POST_JOIN_CHANNEL,
+		Message:   "jane has joined the channel.",
+	}))
+
+	waitFor(t, "jane to be added to pillarteam", func() bool {
+		return len(fake.called("AddTeamMember team-pillarteam jane")) > 0
+	})
+}
+
+func TestHandleMsgFromMonitoredChannelIgnores(t *testing.T) {
+	fake := setupAutoadd(t)
+	lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+	withMonitoredChannel(t, lobby)
+
+	events := []*model.WebSocketEvent{
+		{Event: model.WEBSOCKET_EVENT_POSTED, Data: map[string]interface{}{}},
+		{Event: model.WEBSOCKET_EVENT_POSTED, Data: map[string]interface{}{"post": "{not json"}},
+		postedEvent(&model.Post{Id: "chat", UserId: "jane", ChannelId: lobby.Id, Message: "hello"}),
+		postedEvent(&model.Post{Id: "elsewhere", UserId: "jane", ChannelId: "eng-random", Type: model.POST_JOIN_CHANNEL}),
+	}
+	for _, event := range events {
+		HandleMsgFromMonitoredChannel(event)
+	}
+
+	if calls := fake.called("GetUser", "AddTeamMember"); len(calls) > 0 {
+		t.Errorf("autoadd ran for an event it should ignore: %q", calls)
+	}
+}
+
+func TestHandleMsgFromMonitoredChannelAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		props model.StringInterface
+	}{
+		{"added user id", model.StringInterface{"userId": "admin", "addedUserId": "jane"}},
+		{"added username only", model.StringInterface{"userId": "admin", "addedUsername": "jane"}},
+	}
+
+	for _, test := range tests {
+		fake := setupAutoadd(t)
+		lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+		withMonitoredChannel(t, lobby)
+		ForgetProcessedUser("jane")
+
+		HandleMsgFromMonitoredChannel(postedEvent(&model.Post{
+			Id:        "add-post",
+			UserId:    "admin",
+			ChannelId: lobby.Id,
+			Type:      model.POST_ADD_TO_CHANNEL,
+			Props:     test.props,
+		}))
+
+		waitFor(t, test.name+": jane to be added to pillarteam", func() bool {
+			return len(fake.called("AddTeamMember team-pillarteam jane")) > 0
+		})
+		if calls := fake.called("AddTeamMember team-eng admin"); len(calls) > 0 {
+			t.Errorf("%s: autoadd ran for the adding user: %q", test.name, calls)
+		}
+	}
+}
+
+func TestHandleMsgFromMonitoredChannelIgnoresBotAdds(t *testing.T) {
+	fake := setupAutoadd(t)
+	lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+	withMonitoredChannel(t, lobby)
+
+	HandleMsgFromMonitoredChannel(postedEvent(&model.Post{
+		Id:        "bot-add-post",
+		UserId:    botUser.Id,
+		ChannelId: lobby.Id,
+		Type:      model.POST_ADD_TO_CHANNEL,
+		Props:     model.StringInterface{"userId": botUser.Id, "addedUserId": "jane"},
+	}))
+
+	if !WaitForAdds(5 * time.Second) {
+		t.Fatal("timed out waiting for in-flight work")
+	}
+	if calls := fake.called("GetUser", "AddTeamMember"); len(calls) > 0 {
+		t.Errorf("autoadd ran for an add the bot made: %q", calls)
+	}
+}
+
+func TestHandleMsgFromMonitoredChannelIgnoresBot(t *testing.T) {
+	fake := setupAutoadd(t)
+	lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+	withMonitoredChannel(t, lobby)
+
+	// The bot joining the monitored channel itself
+	HandleMsgFromMonitoredChannel(postedEvent(&model.Post{
+		Id:        "bot-join-post",
+		UserId:    botUser.Id,
+		ChannelId: lobby.Id,
+		Type:      model.POST_JOIN_CHANNEL,
+	}))
+	if !WaitForAdds(5 * time.Second) {
+		t.Fatal("timed out waiting for in-flight work")
+	}
+
+	if teams := HandleNewUserOrExistingUserAdding(botUser.Id); teams != nil {
+		t.Errorf("the bot added itself to %v", teams)
+	}
+	if calls := fake.called("GetUser", "AddTeamMember", "AddChannelMember"); len(calls) > 0 {
+		t.Errorf("autoadd ran for the bot's own activity: %q", calls)
+	}
+}
+
+func TestHandleWebSocketResponseMalformed(t *testing.T) {
+	fake := setupAutoadd(t)
+	lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+	withMonitoredChannel(t, lobby)
+
+	events := []*model.WebSocketEvent{
+		{Event: model.WEBSOCKET_EVENT_POSTED},
+		{Event: model.WEBSOCKET_EVENT_POSTED, Data: map[string]interface{}{"post": 42}},
+		{Event: model.WEBSOCKET_EVENT_POSTED, Data: map[string]interface{}{"post": "null"}},
+		postedEvent(&model.Post{Id: "no-props", UserId: "admin", ChannelId: lobby.Id, Type: model.POST_ADD_TO_CHANNEL}),
+		postedEvent(&model.Post{Id: "bad-props", UserId: "admin", ChannelId: lobby.Id, Type: model.POST_ADD_TO_CHANNEL,
+			Props: model.StringInterface{"addedUserId": 42, "addedUsername": []string{"jane"}}}),
+		{Event: model.WEBSOCKET_EVENT_USER_REMOVED},
+		{Event: model.WEBSOCKET_EVENT_USER_REMOVED, Data: map[string]interface{}{"user_id": 42, "channel_id": nil}},
+	}
+	for _, event := range events {
+		// Unwrapped, so that a panic fails the test
+		HandleWebSocketResponse(event)
+	}
+	if !WaitForAdds(5 * time.Second) {
+		t.Fatal("timed out waiting for in-flight work")
+	}
+
+	if calls := fake.called("GetUser", "GetUserByUsername", "AddTeamMember"); len(calls) > 0 {
+		t.Errorf("autoadd ran for a malformed event: %q", calls)
+	}
+}
+
+func TestHandleWebSocketResponseSafelyRecovers(t *testing.T) {
+	fake := setupAutoadd(t)
+	lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+	withMonitoredChannel(t, lobby)
+
+	// Without a logged in bot user the handler dereferences nil
+	botUser = nil
+	HandleWebSocketResponseSafely(postedEvent(&model.Post{Id: "join-post", UserId: "jane", ChannelId: lobby.Id, Type: model.POST_JOIN_CHANNEL}))
+}
+
+func TestHandleMsgFromMonitoredChannelUnknownUsername(t *testing.T) {
+	fake := setupAutoadd(t)
+	lobby := fake.addChannel(fake.teams["team-eng"], "lobby", model.CHANNEL_OPEN)
+	withMonitoredChannel(t, lobby)
+
+	HandleMsgFromMonitoredChannel(postedEvent(&model.Post{
+		Id: "ghost-post", UserId: "admin", ChannelId: lobby.Id, Type: model.POST_ADD_TO_CHANNEL,
+		Props: model.StringInterface{"addedUsername": "ghost"},
+	}))
+	if calls := fake.called("GetUserByUsername ghost"); len(calls) != 1 {
+		t.Errorf("expected one lookup of the unknown username, got %q", calls)
+	}
+
+	// The next event is still handled
+	HandleMsgFromMonitoredChannel(postedEvent(&model.Post{
+		Id: "join-post", UserId: "jane", ChannelId: lobby.Id, Type: model.POST_JOIN_CHANNEL,
+	}))
+	waitFor(t, "jane to be added to pillarteam", func() bool {
+		return len(fake.called("AddTeamMember team-pillarteam jane")) > 0
+	})
+	if calls := fake.called("AddTeamMember team-eng ghost", "AddTeamMember team-pillarteam ghost"); len(calls) > 0 {
+		t.Errorf("autoadd ran for a username that doesn't exist: %q", calls)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	DEFAULT_HEALTH_PORT     = 8080
+	HEALTH_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+var healthMutex sync.Mutex
+var loggedIn bool
+var webSocketConnected bool
+var healthServer *http.Server
+
+// SetLoggedIn and SetWebSocketConnected record the state /health reports
+func SetLoggedIn(ok bool) {
+	healthMutex.Lock()
+	loggedIn = ok
+	healthMutex.Unlock()
+}
+
+func SetWebSocketConnected(ok bool) {
+	healthMutex.Lock()
+	webSocketConnected = ok
+	healthMutex.Unlock()
+}
+
+// Healthy reports whether the bot is logged in and connected, and if not
+// why.
+func Healthy() (bool, string) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	if !loggedIn {
+		return false, "not logged in"
+	}
+	if !webSocketConnected {
+		return false, "websocket not connected"
+	}
+
+	return true, "ok"
+}
+
+// StartHealthServer serves /health on params.HealthPort, 8080 unless set.
+// A negative port turns it off. /metrics is served alongside unless
+// params.MetricsPort gives it a port of its own.
+func StartHealthServer() {
+	port := Config().HealthPort
+	if port < 0 {
+		return
+	}
+	if port == 0 {
+		port = DEFAULT_HEALTH_PORT
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		ok, reason := Healthy()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(reason + "\nversion " + VersionString() + "\n"))
+	})
+	if Config().MetricsPort == 0 {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+
+	healthServer = serveHTTP("health-server", port, mux)
+}
+
+// StopHealthServer shuts the health server down, letting running requests
+// finish.
+func StopHealthServer() {
+	stopHTTP(healthServer)
+}
+
+// serveHTTP serves mux on port in a task of the given name
+func serveHTTP(task string, port int, mux *http.ServeMux) *http.Server {
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux}
+
+	StartTask(task, func() {
+		logger.Info("Serving HTTP", "task", task, "port", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("The HTTP server stopped", "task", task, "error", err)
+		}
+	})
+
+	return server
+}
+
+func stopHTTP(server *http.Server) {
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	server.Shutdown(ctx)
+}
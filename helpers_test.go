@@ -0,0 +1,36 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// withConfig makes p the running configuration for the rest of the test
+func withConfig(t *testing.T, p *Params) {
+	old := Config()
+
+	paramsMutex.Lock()
+	SetConfig(p)
+	paramsMutex.Unlock()
+
+	t.Cleanup(func() {
+		paramsMutex.Lock()
+		SetConfig(old)
+		paramsMutex.Unlock()
+	})
+}
+
+// waitFor waits up to a few seconds for done to report true, for work the
+// bot hands off to a goroutine
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
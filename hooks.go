@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	STARTUP_HOOK_TIMEOUT = 30 * time.Second
+)
+
+// RunStartupHook runs params.StartupHook once the bot is up. A value
+// starting with http:// or https:// is POSTed to, anything else is run
+// with sh -c. Failures are logged and otherwise ignored.
+func RunStartupHook() {
+	hook := strings.TrimSpace(Config().StartupHook)
+	if hook == "" {
+		return
+	}
+
+	StartTask("startup-hook", func() {
+		var output string
+		var err error
+
+		if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+			output, err = postStartupHook(hook)
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), STARTUP_HOOK_TIMEOUT)
+			var out []byte
+			out, err = exec.CommandContext(ctx, "sh", "-c", hook).CombinedOutput()
+			cancel()
+			output = string(out)
+		}
+
+		if output != "" {
+			logger.Info("Startup hook output", "output", output)
+		}
+		if err != nil {
+			logger.Error("The startup hook failed", "error", err)
+		} else {
+			logger.Info("The startup hook finished")
+		}
+	})
+}
+
+func postStartupHook(url string) (string, error) {
+	httpClient := &http.Client{Timeout: STARTUP_HOOK_TIMEOUT}
+
+	body, _ := json.Marshal(map[string]string{"bot": BOT_NAME, "event": "started", "server": Config().Server})
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	out, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return string(out), errors.New("unexpected response " + resp.Status)
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	IDENTITY_DEFAULT_TTL     = 10 * time.Minute
+	IDENTITY_DEFAULT_TIMEOUT = 5 * time.Second
+)
+
+type identityEntry struct {
+	groups  []string
+	fetched time.Time
+}
+
+var identityMutex sync.Mutex
+var identityCache = map[string]identityEntry{}
+
+// IdentityRules returns the autoadd rules for the groups the identity source
+// puts the user in, merged together. It returns false when the lookup fails
+// or none of the groups is mapped, so the caller falls back to the default
+// rules.
+func IdentityRules(user *model.User) (map[string][]string, bool) {
+	groups, err := IdentityGroups(user)
+	if err != nil {
+		logger.Warn("We failed to look up the groups of the user, using the default rules", "username", user.Username, "error", err)
+		return nil, false
+	}
+
+	var rules map[string][]string
+	for _, group := range groups {
+		set, ok := Config().RuleSets[Config().IdentityGroups[group]]
+		if !ok {
+			continue
+		}
+
+		if rules == nil {
+			rules = map[string][]string{}
+		}
+		for team, channels := range set {
+			for _, channel := range channels {
+				if !in_array(channel, rules[team]) {
+					rules[team] = append(rules[team], channel)
+				}
+			}
+			if _, ok := rules[team]; !ok {
+				rules[team] = []string{}
+			}
+		}
+	}
+
+	return rules, rules != nil
+}
+
+// IdentityGroups returns the user's groups from params.IdentityLookupURL,
+// cached for params.IdentityCacheTTL.
+func IdentityGroups(user *model.User) ([]string, error) {
+	ttl := Config().IdentityCacheTTL
+	if ttl <= 0 {
+		ttl = IDENTITY_DEFAULT_TTL
+	}
+
+	identityMutex.Lock()
+	entry, ok := identityCache[user.Id]
+	identityMutex.Unlock()
+	if ok && time.Since(entry.fetched) < ttl {
+		return entry.groups, nil
+	}
+
+	groups, err := fetchIdentityGroups(user)
+	if err != nil {
+		return nil, err
+	}
+
+	identityMutex.Lock()
+	identityCache[user.Id] = identityEntry{groups: groups, fetched: time.Now()}
+	identityMutex.Unlock()
+
+	return groups, nil
+}
+
+// ResetIdentityCache forgets every cached lookup
+func ResetIdentityCache() {
+	identityMutex.Lock()
+	identityCache = map[string]identityEntry{}
+	identityMutex.Unlock()
+}
+
+// fetchIdentityGroups GETs the lookup URL with the user's id and email and
+// expects {"groups": [...]} back.
+func fetchIdentityGroups(user *model.User) ([]string, error) {
+	timeout := Config().IdentityLookupTimeout
+	if timeout <= 0 {
+		timeout = IDENTITY_DEFAULT_TIMEOUT
+	}
+
+	lookup, err := url.Parse(Config().IdentityLookupURL)
+	if err != nil {
+		return nil, err
+	}
+	query := lookup.Query()
+	query.Set("user_id", user.Id)
+	query.Set("email", user.Email)
+	lookup.RawQuery = query.Encode()
+
+	httpClient := &http.Client{Timeout: timeout}
+	resp, err := httpClient.Get(lookup.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected response " + resp.Status)
+	}
+
+	var body struct {
+		Groups []string `json:"groups"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	return body.Groups, nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	LATENCY_SAMPLES = 60
+)
+
+var latencyMutex sync.Mutex
+var latencySamples [LATENCY_SAMPLES]time.Duration
+var latencyCount int
+var latencyNext int
+
+// RecordLatency stores a sample in the ring buffer, dropping the oldest,
+// and adds it to the latency histogram on /metrics
+func RecordLatency(sample time.Duration) {
+	metricAPILatency.Observe(sample.Seconds())
+
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	latencySamples[latencyNext] = sample
+	latencyNext = (latencyNext + 1) % LATENCY_SAMPLES
+	if latencyCount < LATENCY_SAMPLES {
+		latencyCount++
+	}
+}
+
+// ResetLatency drops all samples
+func ResetLatency() {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	latencyCount = 0
+	latencyNext = 0
+}
+
+// LatencyStats returns the min, average and max of the stored samples
+func LatencyStats() (min time.Duration, avg time.Duration, max time.Duration, count int) {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	if latencyCount == 0 {
+		return 0, 0, 0, 0
+	}
+
+	var total time.Duration
+	min = latencySamples[0]
+	for _, sample := range latencySamples[:latencyCount] {
+		total += sample
+		if sample < min {
+			min = sample
+		}
+		if sample > max {
+			max = sample
+		}
+	}
+
+	return min, total / time.Duration(latencyCount), max, latencyCount
+}
+
+// SampleLatency pings the server every params.LatencySampleInterval and
+// records how long it took to answer.
+func SampleLatency() {
+	if Config().LatencySampleInterval <= 0 {
+		return
+	}
+
+	StartTask("latency-sampler", func() {
+		for range time.Tick(Config().LatencySampleInterval) {
+			TaskActivity("latency-sampler")
+
+			start := time.Now()
+			if _, resp := client.GetPing(); resp.Error != nil {
+				PrintError("We failed to ping the server", resp.Error)
+				continue
+			}
+			RecordLatency(time.Since(start))
+		}
+	})
+}
+
+func HandleLatencyCommand(post *model.Post, args []string) {
+	min, avg, max, count := LatencyStats()
+	if count == 0 {
+		ReplyToPost(post, "No latency samples yet. Is `latencysampleinterval` set?")
+		return
+	}
+
+	ReplyToPost(post, fmt.Sprintf("API latency over the last %d samples: min %s, avg %s, max %s.",
+		count, min.Round(time.Millisecond), avg.Round(time.Millisecond), max.Round(time.Millisecond)))
+}
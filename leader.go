@@ -0,0 +1,186 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_LEADER_LOCK_FILE = "mattermost_bot.lock"
+	DEFAULT_LEADER_TIMEOUT   = 30 * time.Second
+
+	// How long a new leader waits before checking that no other instance
+	// took over at the same time
+	LEADER_CONFIRM_DELAY = time.Second
+)
+
+// leaderLock is the content of the lock file. The leader rewrites it with
+// a fresh heartbeat a few times per timeout.
+type leaderLock struct {
+	Instance  string    `json:"instance"`
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+var leading int32
+var instanceId = fmt.Sprintf("%s/%d", hostname(), os.Getpid())
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+
+	return name
+}
+
+// IsLeader reports whether this instance should handle events. Without
+// leader election every instance is the leader.
+func IsLeader() bool {
+	if !Config().EnableLeaderElection {
+		return true
+	}
+
+	return atomic.LoadInt32(&leading) == 1
+}
+
+// LeaderTimeout is how long the leader may go without a heartbeat before
+// another instance takes over, params.LeaderTimeout or
+// DEFAULT_LEADER_TIMEOUT.
+func LeaderTimeout() time.Duration {
+	if Config().LeaderTimeout <= 0 {
+		return DEFAULT_LEADER_TIMEOUT
+	}
+
+	return Config().LeaderTimeout
+}
+
+func leaderLockFile() string {
+	if Config().LeaderLockFile == "" {
+		return DEFAULT_LEADER_LOCK_FILE
+	}
+
+	return Config().LeaderLockFile
+}
+
+// StartLeaderElection decides whether this instance leads, when
+// params.EnableLeaderElection is set, and keeps deciding in the
+// background: the leader sends heartbeats, the others stand by and take
+// over once the heartbeats stop.
+func StartLeaderElection() {
+	if !Config().EnableLeaderElection {
+		return
+	}
+
+	electLeader()
+
+	StartTask("leader-election", func() {
+		ticker := time.NewTicker(LeaderTimeout() / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-shutdownCtx.Done():
+				return
+			case <-ticker.C:
+				TaskActivity("leader-election")
+				electLeader()
+			}
+		}
+	})
+}
+
+func electLeader() {
+	lock := readLeaderLock()
+	ours := lock != nil && lock.Instance == instanceId
+	stale := lock == nil || time.Since(lock.Heartbeat) >= LeaderTimeout()
+	if !ours && !stale {
+		setLeading(false, lock.Instance)
+		return
+	}
+
+	if err := writeLeaderLock(); err != nil {
+		logger.Error("We failed to write the leader lock", "path", leaderLockFile(), "error", err)
+		setLeading(false, "")
+		return
+	}
+
+	if !ours {
+		time.Sleep(LEADER_CONFIRM_DELAY)
+		if lock = readLeaderLock(); lock == nil || lock.Instance != instanceId {
+			setLeading(false, "")
+			return
+		}
+	}
+
+	setLeading(true, instanceId)
+}
+
+// setLeading records whether this instance leads, logging any change
+func setLeading(ok bool, leader string) {
+	value := int32(0)
+	if ok {
+		value = 1
+	}
+	if atomic.SwapInt32(&leading, value) == value {
+		return
+	}
+
+	if ok {
+		logger.Info("This instance is now the leader", "instance", instanceId)
+	} else {
+		logger.Info("Standing by, another instance is the leader", "instance", instanceId, "leader", leader)
+	}
+}
+
+// readLeaderLock returns the current lock, or nil if there is no readable
+// one, which counts as stale.
+func readLeaderLock() *leaderLock {
+	source, err := ioutil.ReadFile(leaderLockFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("We failed to read the leader lock", "path", leaderLockFile(), "error", err)
+		}
+		return nil
+	}
+
+	lock := &leaderLock{}
+	if err := json.Unmarshal(source, lock); err != nil {
+		logger.Warn("Ignoring a malformed leader lock", "path", leaderLockFile(), "error", err)
+		return nil
+	}
+
+	return lock
+}
+
+func writeLeaderLock() error {
+	data, err := json.Marshal(leaderLock{Instance: instanceId, Heartbeat: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	tmp := leaderLockFile() + "." + fmt.Sprint(os.Getpid()) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, leaderLockFile())
+}
+
+// ReleaseLeadership removes the lock on shutdown, if this instance holds
+// it, so that a standby takes over right away.
+func ReleaseLeadership() {
+	if !Config().EnableLeaderElection || !IsLeader() {
+		return
+	}
+
+	if lock := readLeaderLock(); lock != nil && lock.Instance == instanceId {
+		os.Remove(leaderLockFile())
+	}
+}
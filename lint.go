@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/platform/model"
+)
+
+// LintConfig looks for autoadd rules that are valid YAML but most likely
+// not what was intended. Each warning names the offending rule.
+func LintConfig(p *Params) []string {
+	var warnings []string
+
+	teams := make([]string, 0, len(p.Autoadd))
+	for team_name := range p.Autoadd {
+		teams = append(teams, team_name)
+	}
+	sort.Strings(teams)
+
+	for _, team_name := range teams {
+		channels := p.Autoadd[team_name]
+
+		if strings.TrimSpace(team_name) == "" {
+			warnings = append(warnings, "a rule has an empty team name")
+		}
+
+		if len(channels) == 0 && AutoaddMode(team_name) == AUTOADD_MODE_ONLY_LISTED {
+			warnings = append(warnings, "rule `"+team_name+"` has no channels, users are only added to the team")
+		}
+
+		seen := map[string]bool{}
+		for _, channel := range channels {
+			if strings.TrimSpace(channel) == "" {
+				warnings = append(warnings, "rule `"+team_name+"` has an empty channel entry")
+				continue
+			}
+			if seen[channel] {
+				warnings = append(warnings, "rule `"+team_name+"` lists channel `"+channel+"` more than once")
+			}
+			seen[channel] = true
+		}
+	}
+
+	// An all-except rule lists the channels users are kept out of, so a
+	// channel it lists is excluded whatever else includes it
+	for _, team_name := range teams {
+		if AutoaddMode(team_name) != AUTOADD_MODE_ALL_EXCEPT {
+			continue
+		}
+
+		for _, channel := range p.Autoadd[team_name] {
+			for i, rule := range p.RuleBased {
+				if rule.Team == team_name && in_array(channel, rule.Channels) {
+					warnings = append(warnings, "rule `"+team_name+"` excludes channel `"+channel+"`, which rulebased rule "+strconv.Itoa(i+1)+" includes")
+				}
+			}
+			if p.Teams[team_name].LandingChannel == channel {
+				warnings = append(warnings, "rule `"+team_name+"` excludes channel `"+channel+"`, which is its landing_channel")
+			}
+		}
+	}
+
+	for team_name, options := range p.Teams {
+		if options.Mode != "" && options.Mode != AUTOADD_MODE_ALL_EXCEPT && options.Mode != AUTOADD_MODE_ONLY_LISTED {
+			warnings = append(warnings, "team options for `"+team_name+"` have unknown mode `"+options.Mode+"`")
+		}
+		if _, ok := p.Autoadd[team_name]; !ok {
+			warnings = append(warnings, "team options for `"+team_name+"` have no matching autoadd rule")
+		}
+		if (options.LandingChannel == "") != (options.LandingMessage == "") {
+			warnings = append(warnings, "team options for `"+team_name+"` need both landing_channel and landing_message")
+		}
+	}
+
+	for i, rule := range p.RuleBased {
+		if strings.TrimSpace(rule.Team) == "" {
+			warnings = append(warnings, "rulebased rule "+strconv.Itoa(i+1)+" (`"+rule.Match+"`) has no team")
+		}
+		if rule.Match == "" {
+			warnings = append(warnings, "rulebased rule "+strconv.Itoa(i+1)+" has an empty match, which matches everyone")
+		}
+	}
+
+	for group, set := range p.IdentityGroups {
+		if _, ok := p.RuleSets[set]; !ok {
+			warnings = append(warnings, "identity group `"+group+"` maps to the unknown rule set `"+set+"`")
+		}
+	}
+
+	return warnings
+}
+
+func HandleLintCommand(post *model.Post, args []string) {
+	warnings := LintConfig(Config())
+	if len(warnings) == 0 {
+		ReplyToPost(post, "No problems found in the autoadd config.")
+		return
+	}
+
+	ReplyToPost(post, "Found "+strconv.Itoa(len(warnings))+" possible problem(s):\n- "+strings.Join(warnings, "\n- "))
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintConfigIncludedAndExcluded(t *testing.T) {
+	withConfig(t, &Params{
+		Autoadd: map[string][]string{
+			"pillarteam": {"off-topic", "announcements"},
+			"eng":        {"builds"},
+		},
+		Teams: map[string]TeamOptions{
+			"pillarteam": {LandingChannel: "announcements", LandingMessage: "Welcome!"},
+		},
+		RuleBased: []RegexRule{
+			{Match: "^dev-", Team: "pillarteam", Channels: []string{"off-topic"}},
+			{Match: "^dev-", Team: "eng", Channels: []string{"builds"}},
+		},
+	})
+
+	expected := []string{
+		"rule `pillarteam` excludes channel `off-topic`, which rulebased rule 1 includes",
+		"rule `pillarteam` excludes channel `announcements`, which is its landing_channel",
+	}
+	if warnings := LintConfig(Config()); !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("got %q, expected %q", warnings, expected)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/mattermost/platform/model"
+)
+
+var logLevel = new(slog.LevelVar)
+
+// logger writes leveled key=value lines with timestamps to stderr
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// ParseLogLevel reads a params.LogLevel value: debug, info (the default),
+// warn or error.
+func ParseLogLevel(name string) (slog.Level, error) {
+	if name == "" {
+		name = "info"
+	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+
+	return level, err
+}
+
+// SetLogLevel applies params.LogLevel
+func SetLogLevel(name string) error {
+	level, err := ParseLogLevel(name)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	return nil
+}
+
+// PrintError logs msg at error level with the fields of err attached
+func PrintError(msg string, err *model.AppError, args ...interface{}) {
+	CountError()
+
+	args = append(args, slog.Group("error",
+		"id", err.Id,
+		"message", err.Message,
+		"detailed_error", err.DetailedError,
+		"status_code", err.StatusCode,
+		"request_id", err.RequestId))
+	logger.Error(msg, args...)
+}
+
+// Fatal logs msg at error level and exits
+func Fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
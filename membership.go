@@ -0,0 +1,136 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/platform/model"
+)
+
+// IsTeamMember reports whether the user is an active member of the team
+func IsTeamMember(team_id string, user_id string) bool {
+	member, resp := client.GetTeamMember(team_id, user_id, "")
+	return resp.Error == nil && member != nil && member.DeleteAt == 0
+}
+
+var botTeamsMutex sync.Mutex
+var botTeams = map[string]bool{}
+
+// ResetBotTeams forgets which teams the bot is known to be in
+func ResetBotTeams() {
+	botTeamsMutex.Lock()
+	botTeams = map[string]bool{}
+	botTeamsMutex.Unlock()
+}
+
+// EnsureBotInTeam makes the bot join the team, when params.BotAutoJoinTeams
+// is set and it isn't a member yet, since the server only lets team members
+// add others. Teams the bot is known to be in are not checked again.
+func EnsureBotInTeam(team_id string, team_name string) {
+	if !Config().BotAutoJoinTeams {
+		return
+	}
+
+	botTeamsMutex.Lock()
+	defer botTeamsMutex.Unlock()
+
+	if botTeams[team_id] {
+		return
+	}
+	if IsTeamMember(team_id, botUser.Id) {
+		botTeams[team_id] = true
+		return
+	}
+
+	if DryRun("join the team as the bot", "team", team_name) {
+		return
+	}
+
+	logger.Info("The bot is not a member of the team, joining it first", "team", team_name)
+	if _, resp := client.AddTeamMember(team_id, botUser.Id); resp.Error != nil {
+		PrintError("We failed to join the team as the bot", resp.Error, "team", team_name)
+		return
+	}
+	botTeams[team_id] = true
+}
+
+// HandleTeamsOfCommand reports which autoadd teams a user is in and which
+// they are missing from. With "fix" autoadd runs for the user again, which
+// adds them to the missing teams their rules still give them.
+// Usage: !teamsof <username> [fix]
+func HandleTeamsOfCommand(post *model.Post, args []string) {
+	if len(args) == 0 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"teamsof <username> [fix]`")
+		return
+	}
+
+	user, err := LookupUsername(args[0])
+	if err != nil {
+		ReplyToPost(post, "Could not find user `"+args[0]+"`.")
+		return
+	}
+	fix := len(args) > 1 && args[1] == "fix"
+	if fix && !IsAdmin(post.UserId) {
+		ReplyToPost(post, "Sorry, only bot admins can use `fix`.")
+		return
+	}
+
+	team_names := make([]string, 0, len(Config().Autoadd))
+	for team_name := range Config().Autoadd {
+		team_names = append(team_names, team_name)
+	}
+	sort.Strings(team_names)
+
+	var member_of, missing []string
+	for _, team_name := range team_names {
+		team, resp := client.GetTeamByName(team_name, "")
+		if resp.Error != nil {
+			missing = append(missing, team_name+" (team not found)")
+			continue
+		}
+
+		if IsTeamMember(team.Id, user.Id) {
+			member_of = append(member_of, team_name)
+		} else {
+			missing = append(missing, team_name)
+		}
+	}
+
+	msg := "**@" + user.Username + "**\n- Member of: " + listOrNone(member_of) + "\n- Missing from: " + listOrNone(missing)
+	if !fix || len(missing) == 0 {
+		if fix {
+			msg += "\n- Added to: none"
+		}
+		ReplyToPost(post, msg)
+		return
+	}
+
+	// The fix goes through autoadd itself, so the rules and the guest,
+	// exclusion, deactivation and bot checks apply like for any other add.
+	// It runs off the websocket listener and the report is posted when done.
+	ForgetProcessedUser(user.Id)
+	dispatch("teamsof-fix", func() {
+		added := HandleNewUserOrExistingUserAdding(user.Id)
+
+		var fixed []string
+		for _, team_name := range missing {
+			if in_array(team_name, added) {
+				fixed = append(fixed, team_name)
+			}
+		}
+
+		ReplyToPost(post, msg+"\n- Added to: "+listOrNone(fixed))
+	})
+}
+
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	METRICS_NAMESPACE = "mattermost_bot"
+
+	METRICS_TARGET_TEAM    = "team"
+	METRICS_TARGET_CHANNEL = "channel"
+)
+
+// Prometheus metrics served on /metrics. Adds and failures are labelled
+// with the target, team or channel, events with their websocket type.
+var (
+	metricUsersAdded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "users_added_total",
+		Help:      "Users added to a team or channel.",
+	}, []string{"target"})
+
+	metricAddFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "add_failures_total",
+		Help:      "Adds to a team or channel that failed after all retries.",
+	}, []string{"target"})
+
+	metricReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "websocket_reconnects_total",
+		Help:      "Times the websocket was connected again after dropping.",
+	})
+
+	metricEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "events_received_total",
+		Help:      "Websocket events received, by type.",
+	}, []string{"event"})
+
+	metricAPILatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "api_latency_seconds",
+		Help:      "Time the server took to answer a latency sample ping.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	metricLastSuccessfulAdd = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "last_successful_add_timestamp_seconds",
+		Help:      "Unix time of the last user added by autoadd.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricUsersAdded, metricAddFailures, metricReconnects, metricEvents, metricAPILatency, metricLastSuccessfulAdd)
+}
+
+// CountAddResult records an add to a team or channel for /metrics
+func CountAddResult(target string, ok bool) {
+	if ok {
+		metricUsersAdded.WithLabelValues(target).Inc()
+	} else {
+		metricAddFailures.WithLabelValues(target).Inc()
+	}
+}
+
+var metricsServer *http.Server
+
+// StartMetricsServer serves /metrics on params.MetricsPort. Port 0 leaves
+// it to the health server, which serves it next to /health, and a negative
+// port turns it off.
+func StartMetricsServer() {
+	if Config().MetricsPort <= 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	metricsServer = serveHTTP("metrics-server", Config().MetricsPort, mux)
+}
+
+// StopMetricsServer shuts the metrics server down, if it has its own port
+func StopMetricsServer() {
+	stopHTTP(metricsServer)
+}
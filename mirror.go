@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mattermost/platform/model"
+)
+
+var mirrorMutex sync.Mutex
+
+// mirrorChannelIds caches the ids of the "team/channel" names used in
+// params.MirrorRemovals, which do not change.
+var mirrorChannelIds = map[string]string{}
+
+// HandleUserRemoved removes a user who left, or was removed from, one of
+// the source channels of params.MirrorRemovals from the channels linked to
+// it.
+func HandleUserRemoved(user_id string, channel_id string) {
+	if user_id == "" || channel_id == "" || (botUser != nil && user_id == botUser.Id) {
+		return
+	}
+
+	for source, targets := range Config().MirrorRemovals {
+		if MirrorChannelId(source) != channel_id {
+			continue
+		}
+
+		for _, target := range targets {
+			target_id := MirrorChannelId(target)
+			if target_id == "" {
+				continue
+			}
+
+			if DryRun("remove the user from the linked channel", "user_id", user_id, "channel", target, "source", source) {
+				continue
+			}
+
+			err := retryWithBackoff(MaxRetries(), func() *model.AppError {
+				acquireAddSlot()
+				defer releaseAddSlot()
+
+				_, resp := client.RemoveUserFromChannel(target_id, user_id)
+				return resp.Error
+			})
+			if err != nil {
+				PrintError("We failed to remove the user from the linked channel", err, "user_id", user_id, "channel", target, "source", source)
+				continue
+			}
+
+			logger.Info("Removed the user from the linked channel", "user_id", user_id, "channel", target, "source", source)
+		}
+	}
+}
+
+// ResetMirrorChannelIds forgets the cached mirrorremovals channel ids
+func ResetMirrorChannelIds() {
+	mirrorMutex.Lock()
+	mirrorChannelIds = map[string]string{}
+	mirrorMutex.Unlock()
+}
+
+// MirrorChannelId resolves a "team/channel" name to the channel's id, or
+// "" if it can't be found.
+func MirrorChannelId(name string) string {
+	mirrorMutex.Lock()
+	id, ok := mirrorChannelIds[name]
+	mirrorMutex.Unlock()
+	if ok {
+		return id
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		logger.Warn("mirrorremovals entries must look like team/channel", "entry", name)
+		return ""
+	}
+
+	team, resp := client.GetTeamByName(parts[0], "")
+	if resp.Error != nil {
+		PrintError("We failed to get the team of a mirrorremovals entry", resp.Error, "entry", name)
+		return ""
+	}
+	channel, resp := client.GetChannelByName(parts[1], team.Id, "")
+	if resp.Error != nil {
+		PrintError("We failed to get the channel of a mirrorremovals entry", resp.Error, "entry", name)
+		return ""
+	}
+
+	mirrorMutex.Lock()
+	mirrorChannelIds[name] = channel.Id
+	mirrorMutex.Unlock()
+
+	return channel.Id
+}
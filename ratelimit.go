@@ -0,0 +1,252 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	DEFAULT_REQUESTS_PER_SECOND = 10
+
+	// How often a request answered with 429 Too Many Requests is sent
+	// again, and how long to wait when the server doesn't say
+	RETRY_AFTER_ATTEMPTS      = 3
+	DEFAULT_RETRY_AFTER_DELAY = time.Second
+	MAX_RETRY_AFTER_DELAY     = time.Minute
+)
+
+// RequestsPerSecond is params.RequestsPerSecond, DEFAULT_REQUESTS_PER_SECOND
+// when unset. A negative rate disables limiting.
+func RequestsPerSecond() float64 {
+	if Config().RequestsPerSecond == 0 {
+		return DEFAULT_REQUESTS_PER_SECOND
+	}
+
+	return Config().RequestsPerSecond
+}
+
+// RateLimiter is a token bucket holding up to one second worth of requests.
+// A rate of zero or less disables limiting.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// apiLimiter throttles the calls that change things on the server
+var apiLimiter = &RateLimiter{}
+
+var burstMutex sync.Mutex
+var burstTimer *time.Timer
+
+func (l *RateLimiter) SetRate(rate float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rate = rate
+}
+
+func (l *RateLimiter) Rate() float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.rate
+}
+
+// Wait blocks until a request may be made
+func (l *RateLimiter) Wait() {
+	for {
+		l.mutex.Lock()
+		if l.rate <= 0 {
+			l.mutex.Unlock()
+			return
+		}
+
+		now := time.Now()
+		capacity := l.rate
+		if capacity < 1 {
+			capacity = 1
+		}
+		if !l.last.IsZero() {
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+		} else {
+			l.tokens = capacity
+		}
+		if l.tokens > capacity {
+			l.tokens = capacity
+		}
+		l.last = now
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mutex.Unlock()
+			return
+		}
+
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mutex.Unlock()
+
+		time.Sleep(wait)
+	}
+}
+
+// rateLimitedClient waits for apiLimiter before every call that changes
+// something on the server
+type rateLimitedClient struct {
+	MattermostClient
+}
+
+func (c rateLimitedClient) AddTeamMember(teamId, userId string) (*model.TeamMember, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.AddTeamMember(teamId, userId)
+}
+
+func (c rateLimitedClient) AddChannelMember(channelId, userId string) (*model.ChannelMember, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.AddChannelMember(channelId, userId)
+}
+
+func (c rateLimitedClient) RemoveUserFromChannel(channelId, userId string) (bool, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.RemoveUserFromChannel(channelId, userId)
+}
+
+func (c rateLimitedClient) UpdateChannelRoles(channelId, userId, roles string) (bool, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.UpdateChannelRoles(channelId, userId, roles)
+}
+
+func (c rateLimitedClient) UpdateUser(user *model.User) (*model.User, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.UpdateUser(user)
+}
+
+func (c rateLimitedClient) CreateChannel(channel *model.Channel) (*model.Channel, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.CreateChannel(channel)
+}
+
+func (c rateLimitedClient) CreateDirectChannel(userId1, userId2 string) (*model.Channel, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.CreateDirectChannel(userId1, userId2)
+}
+
+func (c rateLimitedClient) CreatePost(post *model.Post) (*model.Post, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.CreatePost(post)
+}
+
+func (c rateLimitedClient) DeletePost(postId string) (bool, *model.Response) {
+	apiLimiter.Wait()
+	return c.MattermostClient.DeletePost(postId)
+}
+
+// retryAfterTransport sends a request answered with 429 Too Many Requests
+// again once the server's Retry-After has passed, up to
+// RETRY_AFTER_ATTEMPTS times.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= RETRY_AFTER_ATTEMPTS {
+			return resp, err
+		}
+		// A body that can't be read again can't be sent again
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+
+		wait := retryAfterDelay(resp.Header.Get("Retry-After"))
+		resp.Body.Close()
+		logger.Warn("The server is rate limiting us, waiting before trying again", "path", req.URL.Path, "wait", wait)
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		if req.Body != nil {
+			retry := *req
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+			req = &retry
+		}
+	}
+}
+
+// retryAfterDelay reads a Retry-After header, in seconds or as a date,
+// capped at MAX_RETRY_AFTER_DELAY.
+func retryAfterDelay(value string) time.Duration {
+	delay := DEFAULT_RETRY_AFTER_DELAY
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		delay = time.Until(at)
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	if delay > MAX_RETRY_AFTER_DELAY {
+		return MAX_RETRY_AFTER_DELAY
+	}
+
+	return delay
+}
+
+// HandleBurstCommand raises the API rate limit for a while, e.g. before a
+// planned backfill. Usage: !burst <requests per second> <duration>
+func HandleBurstCommand(post *model.Post, args []string) {
+	if len(args) < 2 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"burst <requests per second> <duration>`")
+		return
+	}
+
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || rate <= 0 {
+		ReplyToPost(post, "`"+args[0]+"` is not a valid rate.")
+		return
+	}
+
+	duration, err := time.ParseDuration(args[1])
+	if err != nil || duration <= 0 {
+		ReplyToPost(post, "`"+args[1]+"` is not a valid duration, try something like `15m`.")
+		return
+	}
+
+	if Config().MaxBurstRate <= 0 {
+		ReplyToPost(post, "Bursting is disabled, set `maxburstrate` to allow it.")
+		return
+	}
+	if rate > Config().MaxBurstRate {
+		rate = Config().MaxBurstRate
+	}
+
+	burstMutex.Lock()
+	if burstTimer != nil {
+		burstTimer.Stop()
+	}
+	apiLimiter.SetRate(rate)
+	burstTimer = time.AfterFunc(duration, func() {
+		apiLimiter.SetRate(RequestsPerSecond())
+		logger.Info("Burst over, API rate limit restored", "requests_per_second", RequestsPerSecond())
+	})
+	burstMutex.Unlock()
+
+	logger.Info("API rate limit raised", "requests_per_second", rate, "duration", duration)
+	ReplyToPost(post, fmt.Sprintf("API rate limit raised to %g requests per second for %s.", rate, duration))
+}
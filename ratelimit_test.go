@@ -0,0 +1,134 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterThrottles(t *testing.T) {
+	fake := setupAutoadd(t)
+	old := apiLimiter.Rate()
+	apiLimiter.SetRate(20)
+	t.Cleanup(func() { apiLimiter.SetRate(old) })
+
+	// A full bucket lets the first second's worth through at once, the
+	// next ten take half a second more
+	limited := rateLimitedClient{fake}
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		limited.AddChannelMember("eng-builds", "jane")
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("30 calls at 20 per second took only %v", elapsed)
+	}
+	if calls := fake.called("AddChannelMember"); len(calls) != 30 {
+		t.Errorf("%d of the 30 calls reached the server", len(calls))
+	}
+
+	apiLimiter.SetRate(-1)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		limited.AddChannelMember("eng-builds", "jane")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("calls with limiting disabled took %v", elapsed)
+	}
+}
+
+// rateLimitedServer answers 429 with retry_after the first limited times
+// and records the bodies it was sent
+func rateLimitedServer(t *testing.T, limited int, retry_after string) (*httptest.Server, func() []string) {
+	var mutex sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, string(body))
+		hits := len(bodies)
+		mutex.Unlock()
+
+		if hits <= limited {
+			w.Header().Set("Retry-After", retry_after)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, bodies...)
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	server, bodies := rateLimitedServer(t, 1, "1")
+	http_client := &http.Client{Transport: &retryAfterTransport{base: http.DefaultTransport}}
+
+	start := time.Now()
+	resp, err := http_client.Post(server.URL+"/api/v4/channels/x/members", "application/json", strings.NewReader(`{"user_id":"jane"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d after the retry", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, before the server's Retry-After of 1s", elapsed)
+	}
+	if got := bodies(); len(got) != 2 || got[1] != `{"user_id":"jane"}` {
+		t.Errorf("the server got %q, expected the same body twice", got)
+	}
+}
+
+func TestRetryAfterTransportGivesUp(t *testing.T) {
+	server, bodies := rateLimitedServer(t, RETRY_AFTER_ATTEMPTS+5, "0")
+	http_client := &http.Client{Transport: &retryAfterTransport{base: http.DefaultTransport}}
+
+	resp, err := http_client.Get(server.URL + "/api/v4/users/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got status %d, expected the last 429", resp.StatusCode)
+	}
+	if got := len(bodies()); got != RETRY_AFTER_ATTEMPTS+1 {
+		t.Errorf("sent the request %d times, expected %d", got, RETRY_AFTER_ATTEMPTS+1)
+	}
+}
+
+func TestRetryAfterDelay(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", DEFAULT_RETRY_AFTER_DELAY, DEFAULT_RETRY_AFTER_DELAY},
+		{"soon", DEFAULT_RETRY_AFTER_DELAY, DEFAULT_RETRY_AFTER_DELAY},
+		{"0", 0, 0},
+		{"3", 3 * time.Second, 3 * time.Second},
+		{"86400", MAX_RETRY_AFTER_DELAY, MAX_RETRY_AFTER_DELAY},
+		{time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 8 * time.Second, 10 * time.Second},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0},
+	}
+
+	for _, test := range tests {
+		if delay := retryAfterDelay(test.value); delay < test.min || delay > test.max {
+			t.Errorf("%q: got %v, expected between %v and %v", test.value, delay, test.min, test.max)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/mattermost/platform/model"
+)
+
+// paramsMutex is held while the configuration is swapped for a reloaded
+// one, so readers needing it to match the state derived from it, such as
+// the compiled rules, can hold it off.
+var paramsMutex sync.RWMutex
+
+// currentConfig holds the running *Params. A reload stores a new one
+// instead of changing it, so a snapshot taken with Config() stays
+// consistent for as long as it is used.
+var currentConfig atomic.Value
+
+func init() {
+	currentConfig.Store(&Params{})
+}
+
+// Config returns the running configuration. It must not be modified.
+func Config() *Params {
+	return currentConfig.Load().(*Params)
+}
+
+// SetConfig makes p the running configuration and updates the state
+// derived from it. The caller holds paramsMutex.
+func SetConfig(p *Params) {
+	currentConfig.Store(p)
+	ApplyConfiguration()
+}
+
+// ReloadConfiguration reads the configuration file again and, if it is
+// valid, swaps it in without reconnecting. An invalid file leaves the
+// running configuration alone. The server and channels are only used at
+// startup, changes to them need a restart, credentials are used again by
+// !refreshtoken, and a file
+// pointing at another server is refused since the client and websocket
+// would then talk to different ones.
+func ReloadConfiguration(trigger string) ([]string, error) {
+	p, err := ReadConfiguration(configPath)
+	if err != nil {
+		return nil, err
+	}
+	old := Config()
+	if serverURL(p) != serverURL(old) || webSocketURL(p) != webSocketURL(old) {
+		return nil, errors.New("the server can't change on reload, restart the bot to connect to " + serverURL(p))
+	}
+	templates, err := ReadTemplates(p)
+	if err != nil {
+		return nil, err
+	}
+
+	paramsMutex.Lock()
+	SetConfig(p)
+	SetTemplates(templates)
+	paramsMutex.Unlock()
+
+	apiLimiter.SetRate(RequestsPerSecond())
+	ResetChannelCache()
+
+	debugChannelMutex.Lock()
+	debugChannelDisabled = false
+	debugChannelMutex.Unlock()
+
+	changes := DiffParams(old, p)
+	RecordConfigChange(trigger, changes)
+
+	return changes, nil
+}
+
+// SetupConfigReload reloads the configuration whenever the process
+// receives SIGHUP.
+func SetupConfigReload() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	StartTask("config-reload", func() {
+		for range c {
+			TaskActivity("config-reload")
+
+			changes, err := ReloadConfiguration(CONFIG_TRIGGER_SIGHUP)
+			if err != nil {
+				logger.Error("We failed to reload the configuration, keeping the old one", "path", configPath, "error", err)
+				continue
+			}
+			logger.Info("Configuration reloaded", "path", configPath, "changes", len(changes))
+		}
+	})
+}
+
+// HandleReloadCommand reloads the configuration like SIGHUP does
+func HandleReloadCommand(post *model.Post, args []string) {
+	changes, err := ReloadConfiguration(CONFIG_TRIGGER_COMMAND)
+	if err != nil {
+		ReplyToPost(post, "The configuration is invalid, keeping the old one: "+err.Error())
+		return
+	}
+
+	if len(changes) == 0 {
+		ReplyToPost(post, "Configuration reloaded, nothing changed.")
+		return
+	}
+
+	ReplyToPost(post, "Configuration reloaded:\n- "+strings.Join(changes, "\n- "))
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// At most REPORT_ERROR_LIMIT errors are posted to the debugging channel per
+// REPORT_ERROR_WINDOW, the rest are only logged and counted.
+const (
+	REPORT_ERROR_LIMIT  = 5
+	REPORT_ERROR_WINDOW = time.Minute
+)
+
+var reportMutex sync.Mutex
+var reportWindowStart time.Time
+var reportedInWindow int
+var suppressedReports int
+
+// ResetErrorReports starts the error report window over and drops the
+// count of errors that were only logged
+func ResetErrorReports() {
+	reportMutex.Lock()
+	reportWindowStart = time.Time{}
+	reportedInWindow = 0
+	suppressedReports = 0
+	reportMutex.Unlock()
+}
+
+// reportError logs err and posts a short note about it to the debugging
+// channel, unless too many have been posted lately.
+func reportError(context string, err *model.AppError) {
+	PrintError(context, err)
+
+	// Without the channel the message would only be logged a second time
+	if !DebugChannelAvailable() {
+		return
+	}
+
+	reportMutex.Lock()
+	now := time.Now()
+	if now.Sub(reportWindowStart) >= REPORT_ERROR_WINDOW {
+		reportWindowStart = now
+		reportedInWindow = 0
+	}
+	if reportedInWindow >= REPORT_ERROR_LIMIT {
+		suppressedReports++
+		reportMutex.Unlock()
+		return
+	}
+	reportedInWindow++
+	suppressed := suppressedReports
+	suppressedReports = 0
+	reportMutex.Unlock()
+
+	msg := fmt.Sprintf(":warning: %s: %s (%d)", context, err.Message, err.StatusCode)
+	if suppressed > 0 {
+		msg += fmt.Sprintf("\n_%d more error(s) were only logged._", suppressed)
+	}
+
+	SendMsgToDebuggingChannel(msg, "")
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/platform/model"
+)
+
+// RegexRule adds users whose username or email matches Match to Team and
+// its Channels.
+type RegexRule struct {
+	Match    string   `yaml:"match"`
+	Team     string   `yaml:"team"`
+	Channels []string `yaml:"channels"`
+}
+
+var ruleBasedMutex sync.Mutex
+var ruleBasedPatterns []*regexp.Regexp
+
+func compileRuleBased(p *Params) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, rule := range p.RuleBased {
+		pattern, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// CompileRuleBased compiles the patterns of p.RuleBased for MatchesRule,
+// failing on the first invalid one.
+func CompileRuleBased(p *Params) error {
+	patterns, err := compileRuleBased(p)
+	if err != nil {
+		return err
+	}
+
+	ruleBasedMutex.Lock()
+	ruleBasedPatterns = patterns
+	ruleBasedMutex.Unlock()
+
+	return nil
+}
+
+// MatchesRule reports whether the user's username or email matches the
+// pattern of params.RuleBased[i].
+func MatchesRule(user *model.User, i int) bool {
+	ruleBasedMutex.Lock()
+	defer ruleBasedMutex.Unlock()
+
+	if i >= len(ruleBasedPatterns) {
+		return false
+	}
+	pattern := ruleBasedPatterns[i]
+
+	return pattern.MatchString(user.Username) || (user.Email != "" && pattern.MatchString(user.Email))
+}
+
+// WithMatchingRules returns rules plus every rulebased rule of p the user
+// matches. All matching rules apply, not just the first: their channels are
+// merged into those the user already gets for the team. rules itself is
+// left untouched.
+func WithMatchingRules(p *Params, user *model.User, rules map[string][]string) map[string][]string {
+	var merged map[string][]string
+	for i, rule := range p.RuleBased {
+		if !MatchesRule(user, i) {
+			continue
+		}
+
+		if merged == nil {
+			merged = map[string][]string{}
+			for team, channels := range rules {
+				merged[team] = append([]string(nil), channels...)
+			}
+		}
+
+		// The channels of an all-except rule are exclusions, and the user
+		// joins every other channel of such a team anyway. A team new to
+		// the user keeps the exclusions configured for it.
+		if AutoaddMode(rule.Team) == AUTOADD_MODE_ALL_EXCEPT {
+			if _, ok := merged[rule.Team]; !ok {
+				merged[rule.Team] = append([]string{}, p.Autoadd[rule.Team]...)
+			}
+			continue
+		}
+		if _, ok := merged[rule.Team]; !ok {
+			merged[rule.Team] = []string{}
+		}
+		for _, channel := range rule.Channels {
+			if !in_array(channel, merged[rule.Team]) {
+				merged[rule.Team] = append(merged[rule.Team], channel)
+			}
+		}
+	}
+
+	if merged == nil {
+		return rules
+	}
+
+	return merged
+}
+
+// EmailDomain returns the part of the user's email address after the @,
+// lowercased, or "" without one
+func EmailDomain(user *model.User) string {
+	i := strings.LastIndex(user.Email, "@")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.ToLower(user.Email[i+1:])
+}
+
+// WithDomainRouting returns rules plus the teams p.DomainRouting
+// routes the user's email domain to. A routed team the user doesn't get
+// already comes with its autoadd rule, if it has one. Users whose domain
+// is routed nowhere get rules unchanged, which is left untouched.
+func WithDomainRouting(p *Params, user *model.User, rules map[string][]string) map[string][]string {
+	domain := EmailDomain(user)
+	if domain == "" {
+		return rules
+	}
+
+	var teams []string
+	for routed, routed_teams := range p.DomainRouting {
+		if strings.EqualFold(routed, domain) {
+			teams = append(teams, routed_teams...)
+		}
+	}
+	if len(teams) == 0 {
+		return rules
+	}
+
+	merged := map[string][]string{}
+	for team, channels := range rules {
+		merged[team] = append([]string(nil), channels...)
+	}
+	for _, team := range teams {
+		if _, ok := merged[team]; !ok {
+			merged[team] = append([]string{}, p.Autoadd[team]...)
+		}
+	}
+
+	return merged
+}
+
+// IsExcluded reports whether params.ExcludeUsers lists the user, by id or
+// by username. Usernames may use glob patterns such as svc-*.
+func IsExcluded(user *model.User) bool {
+	return listsUser(Config().ExcludeUsers, user)
+}
+
+// listsUser reports whether one of the entries is the user's id or
+// username, or a glob pattern matching the username
+func listsUser(entries []string, user *model.User) bool {
+	for _, entry := range entries {
+		entry = strings.TrimPrefix(entry, "@")
+		if entry == user.Id || entry == user.Username {
+			return true
+		}
+		if matched, _ := path.Match(entry, user.Username); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateUserPatterns checks the glob patterns of a list of users such
+// as p.ExcludeUsers
+func validateUserPatterns(entries []string) error {
+	for _, entry := range entries {
+		if _, err := path.Match(entry, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
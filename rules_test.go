@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mattermost/platform/model"
+)
+
+func TestWithMatchingRules(t *testing.T) {
+	withConfig(t, &Params{
+		Autoadd: map[string][]string{
+			"pillarteam": {"off-topic"},
+			"eng":        {"town-square"},
+		},
+		RuleBased: []RegexRule{
+			{Match: "^dev-", Team: "pillarteam", Channels: []string{"ignored"}},
+			{Match: "^dev-", Team: "eng", Channels: []string{"builds", "town-square"}},
+			{Match: "^ops-", Team: "eng", Channels: []string{"alerts"}},
+		},
+	})
+
+	rules := map[string][]string{"sales": {"leads"}}
+
+	tests := []struct {
+		username string
+		expected map[string][]string
+	}{
+		{"someone", rules},
+		{"ops-jane", map[string][]string{
+			"sales": {"leads"},
+			"eng":   {"alerts"},
+		}},
+		{"dev-joe", map[string][]string{
+			"sales":      {"leads"},
+			"pillarteam": {"off-topic"},
+			"eng":        {"builds", "town-square"},
+		}},
+	}
+
+	for _, test := range tests {
+		merged := WithMatchingRules(Config(), &model.User{Username: test.username}, rules)
+		if !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.username, merged, test.expected)
+		}
+	}
+
+	if !reflect.DeepEqual(rules, map[string][]string{"sales": {"leads"}}) {
+		t.Errorf("the rules passed in were changed: %v", rules)
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	withConfig(t, &Params{ExcludeUsers: []string{"@svc-*", "k8s-id", "ops"}})
+
+	tests := []struct {
+		user     *model.User
+		excluded bool
+	}{
+		{&model.User{Id: "u1", Username: "svc-jenkins"}, true},
+		{&model.User{Id: "u2", Username: "svc-"}, true},
+		{&model.User{Id: "k8s-id", Username: "kubernetes"}, true},
+		{&model.User{Id: "u3", Username: "ops"}, true},
+		{&model.User{Id: "u4", Username: "svcjenkins"}, false},
+		{&model.User{Id: "u5", Username: "devops"}, false},
+		{&model.User{Id: "u6", Username: "jane"}, false},
+	}
+	for _, test := range tests {
+		if IsExcluded(test.user) != test.excluded {
+			t.Errorf("%s: expected excluded to be %v", test.user.Username, test.excluded)
+		}
+	}
+}
+
+func TestExcludedUsersAreNotAdded(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.ExcludeUsers = []string{"svc-*"}
+	withConfig(t, &p)
+	fake.addUser(&model.User{Id: "jenkins", Username: "svc-jenkins", Email: "jenkins@example.com"})
+
+	if teams := HandleNewUserOrExistingUserAdding("jenkins"); teams != nil {
+		t.Errorf("an excluded user was added to %v", teams)
+	}
+	if calls := fake.called("AddTeamMember", "AddChannelMember"); len(calls) > 0 {
+		t.Errorf("made %q for an excluded user", calls)
+	}
+}
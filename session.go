@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// HandleRefreshTokenCommand reloads the configuration like !reload, so a
+// rotated token or password in the file is picked up, then logs in again
+// and reconnects the websocket with the new token.
+func HandleRefreshTokenCommand(post *model.Post, args []string) {
+	if _, err := ReloadConfiguration(CONFIG_TRIGGER_TOKEN); err != nil {
+		ReplyToPost(post, "The configuration is invalid, keeping the current connection: "+err.Error())
+		return
+	}
+
+	if err := LoginBot(); err != nil {
+		ReplyToPost(post, "Login failed, keeping the current connection: "+err.Message)
+		PrintError("Login failed", err)
+		return
+	}
+
+	if _, resp := client.GetMe(""); resp.Error != nil {
+		ReplyToPost(post, "Logged in, but the new token does not work: "+resp.Error.Message)
+		PrintError("The new token does not work", resp.Error)
+		return
+	}
+
+	// Reply before reconnecting, this handler runs on the websocket being replaced
+	ReplyToPost(post, "Logged in with a fresh token, which checked out fine. Reconnecting the websocket.")
+
+	if err := ConnectWebSocket(); err != nil {
+		PrintError("We failed to reconnect the web socket with the new token", err)
+	}
+}
+
+const (
+	TOKEN_CHECK_INTERVAL = time.Hour
+)
+
+// CurrentSession returns the session the bot is most likely using. The
+// server hides session tokens, so this is the one with the latest activity,
+// which our own request has just bumped.
+func CurrentSession() (*model.Session, *model.AppError) {
+	if _, resp := client.GetMe(""); resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	sessions, resp := client.GetSessions(botUser.Id, "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	var current *model.Session
+	for _, session := range sessions {
+		if current == nil || session.LastActivityAt > current.LastActivityAt {
+			current = session
+		}
+	}
+
+	return current, nil
+}
+
+func sessionExpiry(session *model.Session) time.Time {
+	return time.Unix(0, session.ExpiresAt*int64(time.Millisecond))
+}
+
+// HandleTokenInfoCommand checks the bot's token and reports when it expires
+func HandleTokenInfoCommand(post *model.Post, args []string) {
+	session, err := CurrentSession()
+	if err != nil {
+		ReplyToPost(post, "The bot's token does not work: "+err.Message)
+		return
+	}
+
+	if session == nil || session.ExpiresAt == 0 {
+		ReplyToPost(post, "The bot's token is valid and the server reports no expiry for it.")
+		return
+	}
+
+	expires := sessionExpiry(session)
+	msg := "The bot's token is valid and expires " + expires.UTC().Format(time.RFC3339) +
+		", in " + time.Until(expires).Round(time.Minute).String() + "."
+	if Config().TokenExpiryWarning > 0 && time.Until(expires) < Config().TokenExpiryWarning {
+		msg += " **That is soon**, use `" + CommandPrefix() + "refreshtoken` to get a new one."
+	}
+
+	ReplyToPost(post, msg)
+}
+
+// WatchTokenExpiry checks the token every hour and, once it is within
+// params.TokenExpiryWarning of expiring, warns and logs in again.
+func WatchTokenExpiry() {
+	if Config().TokenExpiryWarning <= 0 {
+		return
+	}
+
+	StartTask("token-watch", func() {
+		for range time.Tick(TOKEN_CHECK_INTERVAL) {
+			TaskActivity("token-watch")
+
+			session, err := CurrentSession()
+			if err != nil {
+				PrintError("!!! The bot's token does not work any more !!!", err)
+				continue
+			}
+			if session == nil || session.ExpiresAt == 0 || time.Until(sessionExpiry(session)) > Config().TokenExpiryWarning {
+				continue
+			}
+
+			logger.Info("The bot's token expires soon, logging in again", "expires_at", sessionExpiry(session).UTC())
+			if err := LoginBot(); err != nil {
+				PrintError("We failed to log in again", err)
+				continue
+			}
+			if err := ConnectWebSocket(); err != nil {
+				PrintError("We failed to reconnect the web socket with the new token", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	DEFAULT_SLOWEST_TRACKED = 10
+)
+
+// AddTiming is how long adding one user to one team and its channels took
+type AddTiming struct {
+	UserId   string
+	Team     string
+	Channels int
+	Duration time.Duration
+	At       time.Time
+}
+
+// timingHeap keeps the fastest of the tracked timings on top, so it can be
+// evicted when a slower one comes in.
+type timingHeap []AddTiming
+
+func (h timingHeap) Len() int            { return len(h) }
+func (h timingHeap) Less(i, j int) bool  { return h[i].Duration < h[j].Duration }
+func (h timingHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timingHeap) Push(x interface{}) { *h = append(*h, x.(AddTiming)) }
+func (h *timingHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+var slowestMutex sync.Mutex
+var slowestAdds timingHeap
+
+// RecordAddTiming keeps the timing if it is among the slowest seen
+func RecordAddTiming(timing AddTiming) {
+	size := Config().SlowestTracked
+	if size <= 0 {
+		size = DEFAULT_SLOWEST_TRACKED
+	}
+
+	slowestMutex.Lock()
+	defer slowestMutex.Unlock()
+
+	if slowestAdds.Len() < size {
+		heap.Push(&slowestAdds, timing)
+		return
+	}
+	if slowestAdds[0].Duration < timing.Duration {
+		slowestAdds[0] = timing
+		heap.Fix(&slowestAdds, 0)
+	}
+}
+
+// ResetSlowestAdds forgets the tracked timings
+func ResetSlowestAdds() {
+	slowestMutex.Lock()
+	defer slowestMutex.Unlock()
+
+	slowestAdds = nil
+}
+
+func HandleSlowestCommand(post *model.Post, args []string) {
+	slowestMutex.Lock()
+	timings := append([]AddTiming(nil), slowestAdds...)
+	slowestMutex.Unlock()
+
+	if len(timings) == 0 {
+		ReplyToPost(post, "No adds have been timed yet.")
+		return
+	}
+
+	sort.Slice(timings, func(i, j int) bool { return timings[i].Duration > timings[j].Duration })
+
+	msg := "| User | Team | Channels | Duration | When |\n|---|---|---|---|---|\n"
+	for _, timing := range timings {
+		msg += fmt.Sprintf("| %s | %s | %d | %s | %s ago |\n", timing.UserId, timing.Team, timing.Channels,
+			timing.Duration.Round(time.Millisecond), time.Since(timing.At).Round(time.Second))
+	}
+
+	ReplyToPost(post, msg)
+}
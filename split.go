@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	CODE_FENCE = "```"
+
+	// Below this a split message would be mostly code fences
+	MIN_POST_LENGTH = 100
+)
+
+// MaxPostLength returns the longest message, in runes, the bot posts at once
+func MaxPostLength() int {
+	if Config().MaxPostLength > 0 {
+		return Config().MaxPostLength
+	}
+
+	return model.POST_MESSAGE_MAX_RUNES
+}
+
+// SplitMessage cuts msg into parts of at most limit runes, breaking at
+// line ends where possible. A code block that spans a break is closed at
+// the end of one part and opened again at the start of the next.
+func SplitMessage(msg string, limit int) []string {
+	if utf8.RuneCountInString(msg) <= limit {
+		return []string{msg}
+	}
+
+	var parts []string
+	var chunk []string
+	chunkLen := 0
+	openFence := ""
+
+	for _, line := range splitLongLines(strings.Split(msg, "\n"), limit/2) {
+		lineLen := utf8.RuneCountInString(line) + 1
+
+		// leave room to close an open code block at the end of this part
+		reserve := 0
+		if openFence != "" {
+			reserve = len(CODE_FENCE) + 1
+		}
+
+		if chunkLen > 0 && chunkLen+lineLen+reserve > limit {
+			if openFence != "" {
+				chunk = append(chunk, CODE_FENCE)
+			}
+			parts = append(parts, strings.Join(chunk, "\n"))
+
+			chunk = nil
+			chunkLen = 0
+			if openFence != "" {
+				chunk = append(chunk, openFence)
+				chunkLen = utf8.RuneCountInString(openFence) + 1
+			}
+		}
+
+		chunk = append(chunk, line)
+		chunkLen += lineLen
+
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, CODE_FENCE) {
+			if openFence == "" {
+				openFence = trimmed
+			} else {
+				openFence = ""
+			}
+		}
+	}
+
+	if len(chunk) > 0 {
+		parts = append(parts, strings.Join(chunk, "\n"))
+	}
+
+	return parts
+}
+
+// splitLongLines breaks up any line longer than size runes, at least one
+func splitLongLines(lines []string, size int) []string {
+	if size < 1 {
+		size = 1
+	}
+
+	var result []string
+	for _, line := range lines {
+		runes := []rune(line)
+		for len(runes) > size {
+			result = append(result, string(runes[:size]))
+			runes = runes[size:]
+		}
+		result = append(result, string(runes))
+	}
+
+	return result
+}
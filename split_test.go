@@ -0,0 +1,38 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	if parts := SplitMessage("short", 100); !reflect.DeepEqual(parts, []string{"short"}) {
+		t.Errorf("a short message was split: %q", parts)
+	}
+
+	msg := strings.Repeat("line of text\n", 20) + CODE_FENCE + "\n" + strings.Repeat("code\n", 20) + CODE_FENCE
+	parts := SplitMessage(msg, 100)
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %d", len(parts))
+	}
+	for i, part := range parts {
+		if utf8.RuneCountInString(part) > 100 {
+			t.Errorf("part %d is %d runes long", i, utf8.RuneCountInString(part))
+		}
+		if strings.Count(part, CODE_FENCE)%2 != 0 {
+			t.Errorf("part %d leaves a code block open: %q", i, part)
+		}
+	}
+}
+
+func TestSplitMessageTinyLimit(t *testing.T) {
+	parts := SplitMessage("abc\ndef", 1)
+	if strings.Join(parts, "") != "abcdef" {
+		t.Errorf("got %q", parts)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counters for the periodic summary, reset by every report
+var summaryMutex sync.Mutex
+var summaryAdds int
+var summaryErrors int
+var summaryReconnects int
+var summaryDestinations = map[string]int{}
+
+// CountAdd, CountError and CountReconnect feed the periodic summary
+func CountAdd()       { countSummary(&summaryAdds) }
+func CountError()     { countSummary(&summaryErrors) }
+func CountReconnect() { countSummary(&summaryReconnects) }
+
+func countSummary(counter *int) {
+	summaryMutex.Lock()
+	*counter++
+	summaryMutex.Unlock()
+}
+
+// ResetSummary clears the counters without posting a summary
+func ResetSummary() {
+	summaryMutex.Lock()
+	summaryAdds, summaryErrors, summaryReconnects = 0, 0, 0
+	summaryDestinations = map[string]int{}
+	summaryMutex.Unlock()
+}
+
+// CountDestination records a user being added to a team, or to a channel
+// of it when channel_name is given.
+func CountDestination(team_name string, channel_name string) {
+	destination := team_name
+	if channel_name != "" {
+		destination += "/" + channel_name
+	}
+
+	summaryMutex.Lock()
+	summaryDestinations[destination]++
+	summaryMutex.Unlock()
+}
+
+// PostSummaries posts a report to the debug channel every
+// params.SummaryInterval. Each report covers the time since the previous one.
+// It stops when the bot shuts down.
+func PostSummaries() {
+	interval := Config().SummaryInterval
+	if interval <= 0 {
+		return
+	}
+
+	StartTask("summary", func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-shutdownCtx.Done():
+				return
+			case <-ticker.C:
+				TaskActivity("summary")
+				SendMsgToDebuggingChannel(BuildSummary(interval), "")
+			}
+		}
+	})
+}
+
+// BuildSummary reports the counters since the previous summary and resets
+// them, followed by the member counts of the channels autoadd adds users
+// to, which for an all-except team are all of its channels but the
+// excluded ones.
+func BuildSummary(interval time.Duration) string {
+	summaryMutex.Lock()
+	adds, errors, reconnects := summaryAdds, summaryErrors, summaryReconnects
+	destinations := summaryDestinations
+	summaryAdds, summaryErrors, summaryReconnects = 0, 0, 0
+	summaryDestinations = map[string]int{}
+	summaryMutex.Unlock()
+
+	msg := fmt.Sprintf("#### Summary of the last %s\n", interval)
+	msg += fmt.Sprintf("- users added: %d\n- errors: %d\n- websocket reconnects: %d\n", adds, errors, reconnects)
+
+	if len(destinations) > 0 {
+		var lines []string
+		for destination, count := range destinations {
+			lines = append(lines, fmt.Sprintf("%s: %d", destination, count))
+		}
+		sort.Strings(lines)
+		msg += "\nAdded to:\n- " + strings.Join(lines, "\n- ") + "\n"
+	}
+
+	var sizes []string
+	for team_name, rule := range Config().Autoadd {
+		team, resp := client.GetTeamByName(team_name, "")
+		if resp.Error != nil {
+			continue
+		}
+		channels, err := ChannelsToJoin(team, team_name, rule)
+		if err != nil {
+			continue
+		}
+
+		for _, channel_name := range channels {
+			channel, resp := ResolveChannel(channel_name, team.Id)
+			if resp.Error != nil {
+				continue
+			}
+			stats, resp := client.GetChannelStats(channel.Id, "")
+			if resp.Error != nil {
+				continue
+			}
+			sizes = append(sizes, fmt.Sprintf("%s/%s: %d", team_name, channel_name, stats.MemberCount))
+		}
+	}
+
+	if len(sizes) > 0 {
+		sort.Strings(sizes)
+		msg += "\nChannel sizes:\n- " + strings.Join(sizes, "\n- ") + "\n"
+	}
+
+	return msg
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// BackgroundTask describes a named goroutine started by the bot
+type BackgroundTask struct {
+	Name         string
+	Running      bool
+	StartedAt    time.Time
+	LastActivity time.Time
+}
+
+var tasksMutex sync.Mutex
+var backgroundTasks = map[string]*BackgroundTask{}
+
+// StartTask runs fn in its own goroutine and keeps track of it under name
+// so it shows up in the !tasks command.
+func StartTask(name string, fn func()) {
+	now := time.Now()
+
+	task := &BackgroundTask{Name: name, Running: true, StartedAt: now, LastActivity: now}
+
+	tasksMutex.Lock()
+	backgroundTasks[name] = task
+	tasksMutex.Unlock()
+
+	go func() {
+		// A task restarted under the same name replaces this one, so only
+		// ever mark our own entry as stopped.
+		defer func() {
+			tasksMutex.Lock()
+			task.Running = false
+			task.LastActivity = time.Now()
+			tasksMutex.Unlock()
+		}()
+
+		fn()
+	}()
+}
+
+// TaskActivity records that the named task is still doing work
+func TaskActivity(name string) {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+
+	if task, ok := backgroundTasks[name]; ok {
+		task.LastActivity = time.Now()
+	}
+}
+
+// ListTasks returns a snapshot of all known tasks ordered by name
+func ListTasks() []BackgroundTask {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+
+	tasks := make([]BackgroundTask, 0, len(backgroundTasks))
+	for _, task := range backgroundTasks {
+		tasks = append(tasks, *task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+
+	return tasks
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Template values in config.yaml may be written as "@file:path/to/file"
+// to keep long or multiline text out of the main configuration. Relative
+// paths are relative to the directory of the configuration file.
+const (
+	TEMPLATE_FILE_PREFIX = "@file:"
+)
+
+var templatesMutex sync.RWMutex
+var templateFiles = map[string]string{}
+
+// templateFields returns the config values that hold message templates
+func templateFields(p *Params) []string {
+	fields := []string{p.WelcomeDM, p.WelcomeDigestTemplate, p.WelcomeMessage}
+	for _, options := range p.Teams {
+		fields = append(fields, options.LandingMessage)
+		for _, channel := range options.Channels {
+			fields = append(fields, channel.Welcome, channel.Digest)
+		}
+	}
+
+	return fields
+}
+
+// templatePath resolves a template file path against the directory of
+// the configuration file
+func templatePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(filepath.Dir(configPath), path)
+}
+
+// ReadTemplates reads every template file referenced by p, keyed by the
+// path as written in the configuration. It fails if any referenced file
+// cannot be read.
+func ReadTemplates(p *Params) (map[string]string, error) {
+	files := map[string]string{}
+
+	for _, value := range templateFields(p) {
+		if !strings.HasPrefix(value, TEMPLATE_FILE_PREFIX) {
+			continue
+		}
+
+		path := strings.TrimSpace(strings.TrimPrefix(value, TEMPLATE_FILE_PREFIX))
+		source, err := ioutil.ReadFile(templatePath(path))
+		if err != nil {
+			return nil, err
+		}
+		files[path] = string(source)
+	}
+
+	return files, nil
+}
+
+// SetTemplates makes files, from ReadTemplates, the templates in use
+func SetTemplates(files map[string]string) {
+	templatesMutex.Lock()
+	templateFiles = files
+	templatesMutex.Unlock()
+}
+
+// TemplateText resolves a template value from config to the text to use
+func TemplateText(value string) string {
+	if !strings.HasPrefix(value, TEMPLATE_FILE_PREFIX) {
+		return value
+	}
+
+	path := strings.TrimSpace(strings.TrimPrefix(value, TEMPLATE_FILE_PREFIX))
+
+	templatesMutex.RLock()
+	defer templatesMutex.RUnlock()
+
+	return templateFiles[path]
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadTemplatesRelativeToConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "welcome.md"), []byte("Hello @{{username}}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	old := configPath
+	configPath = filepath.Join(dir, "config.yaml")
+	defer func() { configPath = old }()
+
+	files, err := ReadTemplates(&Params{WelcomeDM: TEMPLATE_FILE_PREFIX + "welcome.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTemplates(files)
+	defer SetTemplates(map[string]string{})
+
+	if text := TemplateText(TEMPLATE_FILE_PREFIX + "welcome.md"); text != "Hello @{{username}}" {
+		t.Errorf("got %q", text)
+	}
+
+	if _, err := ReadTemplates(&Params{WelcomeDM: TEMPLATE_FILE_PREFIX + "missing.md"}); err == nil {
+		t.Error("a missing template file was accepted")
+	}
+}
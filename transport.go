@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SetupTransport makes the API client and the websocket connect through
+// the configured proxies and trust the configured CA, and the API client
+// wait out the server's rate limits.
+func SetupTransport() {
+	tls_config, err := TLSConfig(Config())
+	if err != nil {
+		Fatal("We failed to set up TLS", "cacertfile", Config().CACertFile, "error", err)
+	}
+	if Config().InsecureSkipVerify {
+		logger.Warn("!!! insecureskipverify is set, the server's certificate is NOT checked and the connection can be intercepted !!!")
+	}
+
+	apiClient.HttpClient.Transport = &retryAfterTransport{base: &http.Transport{
+		Proxy:           ProxyURL,
+		TLSClientConfig: tls_config,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}}
+
+	// The model package opens the websocket with the default dialer
+	websocket.DefaultDialer.Proxy = ProxyURL
+	websocket.DefaultDialer.TLSClientConfig = tls_config
+}
+
+// TLSConfig returns the TLS settings for connecting to the server: the
+// system CAs plus those in p.CACertFile, and no certificate checks at all
+// with p.InsecureSkipVerify.
+func TLSConfig(p *Params) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: p.InsecureSkipVerify}
+	if p.CACertFile == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(p.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no PEM certificates found in " + p.CACertFile)
+	}
+	config.RootCAs = pool
+
+	return config, nil
+}
+
+// ProxyURL picks params.HTTPSProxy for https and wss requests and
+// params.HTTPProxy for the others. When that is empty it falls back to the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func ProxyURL(req *http.Request) (*url.URL, error) {
+	proxy := Config().HTTPProxy
+	if req.URL.Scheme == "https" || req.URL.Scheme == "wss" {
+		proxy = Config().HTTPSProxy
+	}
+	if proxy == "" {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	return url.Parse(proxy)
+}
+
+// validateProxies checks that the configured proxies are URLs
+func validateProxies(p *Params) error {
+	for _, proxy := range []string{p.HTTPProxy, p.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		if _, err := url.Parse(proxy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+// Set at build time, e.g. go build -ldflags "-X main.version=1.2.0", see
+// GO_LINKER_FLAGS in the Makefile
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// VersionString describes the running build
+func VersionString() string {
+	return version + " (commit " + commit + ", built " + buildDate + ")"
+}
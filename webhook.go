@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/mattermost/platform/model"
+)
+
+// Membership is one user in one autoadd channel, as sent by !syncstate
+type Membership struct {
+	Team    string `json:"team"`
+	Channel string `json:"channel"`
+	UserId  string `json:"user_id"`
+}
+
+// HandleSyncStateCommand POSTs every membership of the autoadd channels to
+// params.WebhookURL as a JSON array, streamed as it is gathered.
+func HandleSyncStateCommand(post *model.Post, args []string) {
+	if Config().WebhookURL == "" {
+		ReplyToPost(post, "No `webhookurl` is configured.")
+		return
+	}
+
+	StartTask("syncstate", func() {
+		ReplyToPost(post, "Gathering the autoadd memberships and sending them to the webhook.")
+
+		reader, writer := io.Pipe()
+		type result struct {
+			count int
+			err   error
+		}
+		done := make(chan result, 1)
+		go func() {
+			count, err := writeMembershipSnapshot(writer)
+			writer.CloseWithError(err)
+			done <- result{count, err}
+		}()
+
+		resp, err := http.Post(Config().WebhookURL, "application/json", reader)
+		// Unblocks the writer if the webhook answered without reading it all
+		reader.Close()
+		written := <-done
+
+		if err != nil {
+			ReplyToPost(post, "Sending the memberships failed: "+err.Error())
+			return
+		}
+		resp.Body.Close()
+
+		if written.err != nil {
+			ReplyToPost(post, fmt.Sprintf("Gathering the memberships failed after %d: %s", written.count, written.err.Error()))
+			return
+		}
+		if resp.StatusCode >= 300 {
+			ReplyToPost(post, "The webhook answered "+resp.Status+".")
+			return
+		}
+
+		ReplyToPost(post, fmt.Sprintf("Sent %d memberships to the webhook.", written.count))
+	})
+}
+
+// writeMembershipSnapshot writes the members of every autoadd channel to w
+// as a JSON array and returns how many it wrote.
+func writeMembershipSnapshot(w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+	count := 0
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return count, err
+	}
+
+	for team_name, rule := range Config().Autoadd {
+		team, resp := client.GetTeamByName(team_name, "")
+		if resp.Error != nil {
+			return count, resp.Error
+		}
+
+		channels, err := ChannelsToJoin(team, team_name, rule)
+		if err != nil {
+			return count, err
+		}
+
+		for _, channel_name := range channels {
+			if channel_name == "" {
+				continue
+			}
+
+			channel, resp := ResolveChannel(channel_name, team.Id)
+			if resp.Error != nil {
+				PrintError("Skipping channel in the snapshot", resp.Error, "channel", channel_name, "team", team_name)
+				continue
+			}
+
+			for page := 0; ; page++ {
+				TaskActivity("syncstate")
+
+				members, resp := client.GetChannelMembers(channel.Id, page, BACKFILL_PAGE_SIZE, "")
+				if resp.Error != nil {
+					return count, resp.Error
+				}
+				if members == nil || len(*members) == 0 {
+					break
+				}
+
+				for _, member := range *members {
+					if count > 0 {
+						if _, err := io.WriteString(w, ","); err != nil {
+							return count, err
+						}
+					}
+					if err := encoder.Encode(Membership{Team: team_name, Channel: channel_name, UserId: member.UserId}); err != nil {
+						return count, err
+					}
+					count++
+				}
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, "]")
+	return count, err
+}
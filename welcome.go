@@ -0,0 +1,376 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// TeamOptions holds per-team settings, keyed by team name under "teams"
+// in config.yaml.
+type TeamOptions struct {
+	Mode           string                    `yaml:"mode"`
+	LandingChannel string                    `yaml:"landing_channel"`
+	LandingMessage string                    `yaml:"landing_message"`
+	Channels       map[string]ChannelOptions `yaml:"channels"`
+}
+
+// ChannelOptions holds per-channel settings, keyed by channel name under
+// the team's "channels"
+type ChannelOptions struct {
+	NoWelcome bool   `yaml:"no_welcome"`
+	Welcome   string `yaml:"welcome"`
+	Digest    string `yaml:"digest"`
+	Role      string `yaml:"role"`
+}
+
+// WelcomeMuted reports whether welcome posts are turned off for the channel
+func WelcomeMuted(team_name string, channel_name string) bool {
+	return Config().Teams[team_name].Channels[channel_name].NoWelcome
+}
+
+const (
+	WELCOME_RETRY_BASE = 5 * time.Second
+	WELCOME_RETRY_MAX  = 5 * time.Minute
+
+	DEFAULT_WELCOME_DIGEST = "Welcome @{{username}}! You have been added to:\n{{channels}}"
+)
+
+var welcomeMutex sync.Mutex
+var welcomedUsers = map[string]time.Time{}
+
+// RenderTemplate fills in the placeholders of a message template. Extra
+// placeholder/value pairs may be given after the user.
+func RenderTemplate(template string, user *model.User, extra ...string) string {
+	pairs := append([]string{"{{username}}", user.Username}, extra...)
+
+	return strings.NewReplacer(pairs...).Replace(TemplateText(template))
+}
+
+// PostLandingMessage greets the user in the landing channel configured for
+// the team, if any.
+func PostLandingMessage(user_id string, team_id string, team_name string) {
+	options, ok := Config().Teams[team_name]
+	if !ok || options.LandingChannel == "" || options.LandingMessage == "" {
+		return
+	}
+	if WelcomeMuted(team_name, options.LandingChannel) {
+		return
+	}
+
+	user, resp := client.GetUser(user_id, "")
+	if resp.Error != nil {
+		PrintError("We failed to look up the user for the landing message", resp.Error, "user_id", user_id)
+		return
+	}
+
+	channel, resp := client.GetChannelByName(options.LandingChannel, team_id, "")
+	if resp.Error != nil {
+		PrintError("We failed to get the landing channel", resp.Error, "channel", options.LandingChannel, "team", team_name)
+		return
+	}
+
+	post := &model.Post{}
+	post.ChannelId = channel.Id
+	post.Message = RenderTemplate(options.LandingMessage, user)
+
+	if DryRun("post the landing message", "channel", options.LandingChannel, "username", user.Username) {
+		return
+	}
+
+	if _, resp := client.CreatePost(post); resp.Error != nil {
+		PrintError("We failed to post the landing message", resp.Error, "channel", options.LandingChannel)
+	}
+}
+
+// ChannelWelcomeMessage returns the message posted to users added to the
+// channel: its own welcome, else params.WelcomeMessage.
+func ChannelWelcomeMessage(team_name string, channel_name string) string {
+	if message := Config().Teams[team_name].Channels[channel_name].Welcome; message != "" {
+		return message
+	}
+
+	return Config().WelcomeMessage
+}
+
+// HasChannelWelcomes reports whether users added to the team's channels
+// may be greeted there at all
+func HasChannelWelcomes(team_name string) bool {
+	if Config().WelcomeMessage != "" {
+		return true
+	}
+
+	for _, options := range Config().Teams[team_name].Channels {
+		if options.Welcome != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PostChannelWelcome greets the user in a channel they were just added to
+// with ChannelWelcomeMessage, unless welcomes are muted there.
+func PostChannelWelcome(user *model.User, channel *model.Channel, team_name string) {
+	message := ChannelWelcomeMessage(team_name, channel.Name)
+	if message == "" || WelcomeMuted(team_name, channel.Name) {
+		return
+	}
+
+	post := &model.Post{}
+	post.ChannelId = channel.Id
+	post.Message = RenderTemplate(message, user, "{{channel}}", channel.Name)
+
+	if DryRun("post the welcome message", "channel", channel.Name, "username", user.Username) {
+		return
+	}
+
+	if _, resp := client.CreatePost(post); resp.Error != nil {
+		PrintError("We failed to post the welcome message", resp.Error, "channel", channel.Name, "team", team_name)
+	}
+}
+
+// SendWelcome sends the user one DM for everything a single autoadd pass
+// did: params.WelcomeDM, or the digest with params.WelcomeDigest, followed
+// by the channel summary with params.SendDMSummary. channels holds the
+// channels joined, keyed by team. Users already welcomed within
+// params.WelcomeDMWindow are skipped.
+func SendWelcome(user *model.User, teams []string, channels map[string][]string) {
+	var parts []string
+	if Config().WelcomeDigest {
+		parts = append(parts, welcomeDigest(user, channels))
+	} else if Config().WelcomeDM != "" {
+		parts = append(parts, RenderTemplate(Config().WelcomeDM, user, "{{teams}}", strings.Join(teams, ", ")))
+	}
+	if Config().SendDMSummary {
+		parts = append(parts, channelSummary(channels))
+	}
+
+	var message []string
+	for _, part := range parts {
+		if part != "" {
+			message = append(message, part)
+		}
+	}
+	if len(message) == 0 || alreadyWelcomed(user.Id) {
+		return
+	}
+
+	sendWelcome(user, strings.Join(message, "\n\n"))
+}
+
+// welcomeDigest lists every channel the user was just added to, keyed by
+// team, along with each channel's welcome snippet, or returns "" for none.
+func welcomeDigest(user *model.User, channels map[string][]string) string {
+	var lines []string
+	for _, team_name := range sortedTeams(channels) {
+		for _, channel_name := range channels[team_name] {
+			line := "- **" + team_name + "** ~" + channel_name
+			if options := Config().Teams[team_name].Channels[channel_name]; options.Digest != "" && !options.NoWelcome {
+				line += ": " + RenderTemplate(options.Digest, user, "{{channel}}", channel_name)
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	template := Config().WelcomeDigestTemplate
+	if template == "" {
+		template = DEFAULT_WELCOME_DIGEST
+	}
+
+	return RenderTemplate(template, user, "{{channels}}", strings.Join(lines, "\n"))
+}
+
+// channelSummary lists the channels the user was just added to, by team,
+// or returns "" for none. Channels that failed to add are not in channels.
+func channelSummary(channels map[string][]string) string {
+	var lines []string
+	for _, team_name := range sortedTeams(channels) {
+		if joined := channels[team_name]; len(joined) > 0 {
+			lines = append(lines, "- **"+team_name+"**: ~"+strings.Join(joined, ", ~"))
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return "You have been added to these channels:\n" + strings.Join(lines, "\n")
+}
+
+func sortedTeams(channels map[string][]string) []string {
+	teams := make([]string, 0, len(channels))
+	for team_name := range channels {
+		teams = append(teams, team_name)
+	}
+	sort.Strings(teams)
+
+	return teams
+}
+
+// ResetWelcomedUsers forgets who has been welcomed, so they may be
+// welcomed again
+func ResetWelcomedUsers() {
+	welcomeMutex.Lock()
+	defer welcomeMutex.Unlock()
+
+	welcomedUsers = map[string]time.Time{}
+}
+
+// alreadyWelcomed reports whether the user got a welcome DM within
+// params.WelcomeDMWindow
+func alreadyWelcomed(user_id string) bool {
+	welcomeMutex.Lock()
+	defer welcomeMutex.Unlock()
+
+	now := time.Now()
+	for id, sent := range welcomedUsers {
+		if now.Sub(sent) >= Config().WelcomeDMWindow {
+			delete(welcomedUsers, id)
+		}
+	}
+	_, welcomed := welcomedUsers[user_id]
+
+	return welcomed
+}
+
+// markWelcomed records that a welcome DM reached the user just now
+func markWelcomed(user_id string) {
+	if Config().WelcomeDMWindow <= 0 {
+		return
+	}
+
+	welcomeMutex.Lock()
+	welcomedUsers[user_id] = time.Now()
+	welcomeMutex.Unlock()
+}
+
+// sendWelcome sends the DM in the background, so the add doesn't wait on
+// it, and shutdown waits for it like for an add. Once shutdown has begun it
+// is left to DrainPendingWelcomes instead.
+func sendWelcome(user *model.User, message string) {
+	if DryRun("send the welcome message", "username", user.Username) {
+		return
+	}
+
+	welcome := &pendingWelcome{UserId: user.Id, Username: user.Username, Message: message}
+	if !beginWork() {
+		welcomeMutex.Lock()
+		pendingWelcomes = append(pendingWelcomes, welcome)
+		welcomeMutex.Unlock()
+		return
+	}
+
+	go func() {
+		defer endWork()
+
+		if err := deliverWelcomeDM(welcome.UserId, welcome.Message); err != nil {
+			PrintError("We failed to send the welcome message, will retry", err, "username", welcome.Username)
+			queueWelcomeRetry(welcome)
+			return
+		}
+		markWelcomed(welcome.UserId)
+	}()
+}
+
+func deliverWelcomeDM(user_id string, message string) *model.AppError {
+	channel, resp := client.CreateDirectChannel(botUser.Id, user_id)
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	post := &model.Post{}
+	post.ChannelId = channel.Id
+	post.Message = message
+
+	if _, resp := client.CreatePost(post); resp.Error != nil {
+		return resp.Error
+	}
+
+	return nil
+}
+
+// A welcome DM that failed and is waiting to be sent again
+type pendingWelcome struct {
+	UserId   string
+	Username string
+	Message  string
+	Attempts int
+	NextTry  time.Time
+}
+
+var pendingWelcomes []*pendingWelcome
+
+func queueWelcomeRetry(welcome *pendingWelcome) {
+	welcome.Attempts++
+	if welcome.Attempts > Config().WelcomeRetries {
+		logger.Warn("Giving up on the welcome message", "username", welcome.Username)
+		return
+	}
+	welcome.NextTry = time.Now().Add(BackoffDelay(WELCOME_RETRY_BASE, WELCOME_RETRY_MAX, welcome.Attempts-1))
+
+	welcomeMutex.Lock()
+	pendingWelcomes = append(pendingWelcomes, welcome)
+	welcomeMutex.Unlock()
+}
+
+// takeWelcomes removes and returns the pending welcomes due at now, or all
+// of them when all is set.
+func takeWelcomes(now time.Time, all bool) []*pendingWelcome {
+	welcomeMutex.Lock()
+	defer welcomeMutex.Unlock()
+
+	var due []*pendingWelcome
+	remaining := pendingWelcomes[:0]
+	for _, welcome := range pendingWelcomes {
+		if all || !welcome.NextTry.After(now) {
+			due = append(due, welcome)
+		} else {
+			remaining = append(remaining, welcome)
+		}
+	}
+	pendingWelcomes = remaining
+
+	return due
+}
+
+// RetryWelcomes resends failed welcome DMs in the background until they
+// go through or params.WelcomeRetries is used up.
+func RetryWelcomes() {
+	if Config().WelcomeRetries <= 0 {
+		return
+	}
+
+	StartTask("welcome-retry", func() {
+		for now := range time.Tick(time.Second) {
+			for _, welcome := range takeWelcomes(now, false) {
+				TaskActivity("welcome-retry")
+
+				if err := deliverWelcomeDM(welcome.UserId, welcome.Message); err != nil {
+					PrintError("We failed to send the welcome message again", err, "username", welcome.Username)
+					queueWelcomeRetry(welcome)
+					continue
+				}
+				markWelcomed(welcome.UserId)
+			}
+		}
+	})
+}
+
+// DrainPendingWelcomes makes a last attempt at every pending welcome DM,
+// called on shutdown.
+func DrainPendingWelcomes() {
+	for _, welcome := range takeWelcomes(time.Now(), true) {
+		if err := deliverWelcomeDM(welcome.UserId, welcome.Message); err != nil {
+			PrintError("We failed to send the welcome message before shutting down", err, "username", welcome.Username)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// welcomeDMs runs autoadd for jane and returns the DMs she got
+func welcomeDMs(t *testing.T, fake *fakeClient) []string {
+	HandleNewUserOrExistingUserAdding("jane")
+	if !WaitForAdds(5 * time.Second) {
+		t.Fatal("timed out waiting for the welcome DM")
+	}
+
+	return fake.postsTo("dm-bot-jane")
+}
+
+func TestSendWelcomeOnePerPass(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.WelcomeDM = "Welcome @{{username}} to {{teams}}"
+	p.WelcomeDMWindow = time.Hour
+	p.SendDMSummary = true
+	withConfig(t, &p)
+	t.Cleanup(ResetWelcomedUsers)
+
+	dms := welcomeDMs(t, fake)
+	if len(dms) != 1 {
+		t.Fatalf("got %d DMs for a two team add, expected 1: %q", len(dms), dms)
+	}
+	for _, part := range []string{"Welcome @jane to ", "- **eng**: ~builds, ~town-square", "- **pillarteam**: ~"} {
+		if !strings.Contains(dms[0], part) {
+			t.Errorf("the DM lacks %q: %q", part, dms[0])
+		}
+	}
+
+	if dms := welcomeDMs(t, fake); len(dms) != 1 {
+		t.Errorf("jane was welcomed again within the window: %q", dms)
+	}
+}
+
+func TestSendWelcomeFailedIsNotMarked(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.WelcomeDM = "Welcome @{{username}}"
+	p.WelcomeDMWindow = time.Hour
+	withConfig(t, &p)
+	t.Cleanup(ResetWelcomedUsers)
+
+	fake.failOn("CreatePost dm-bot-jane", http.StatusInternalServerError)
+	if dms := welcomeDMs(t, fake); len(dms) != 0 {
+		t.Fatalf("a failing DM was posted: %q", dms)
+	}
+	if alreadyWelcomed("jane") {
+		t.Error("jane counts as welcomed although the DM failed")
+	}
+
+	delete(fake.failures, "CreatePost dm-bot-jane")
+	if dms := welcomeDMs(t, fake); len(dms) != 1 {
+		t.Errorf("got %q after the server recovered, expected one DM", dms)
+	}
+}
+
+func TestWelcomeDigest(t *testing.T) {
+	withConfig(t, &Params{
+		Teams: map[string]TeamOptions{
+			"eng": {Channels: map[string]ChannelOptions{
+				"builds": {Digest: "CI results for {{username}} go to ~{{channel}}"},
+				"quiet":  {Digest: "never shown", NoWelcome: true},
+			}},
+		},
+	})
+	user := &model.User{Id: "jane", Username: "jane"}
+	channels := map[string][]string{
+		"pillarteam": {"town-square"},
+		"eng":        {"builds", "quiet"},
+	}
+
+	expected := "Welcome @jane! You have been added to:\n" +
+		"- **eng** ~builds: CI results for jane go to ~builds\n" +
+		"- **eng** ~quiet\n" +
+		"- **pillarteam** ~town-square"
+	if digest := welcomeDigest(user, channels); digest != expected {
+		t.Errorf("got the digest\n%s\nexpected\n%s", digest, expected)
+	}
+
+	p := *Config()
+	p.WelcomeDigestTemplate = "{{username}} joined:\n{{channels}}"
+	withConfig(t, &p)
+	if digest := welcomeDigest(user, map[string][]string{"eng": {"quiet"}}); digest != "jane joined:\n- **eng** ~quiet" {
+		t.Errorf("got %q with a custom template", digest)
+	}
+
+	if digest := welcomeDigest(user, map[string][]string{"eng": nil}); digest != "" {
+		t.Errorf("got %q for no channels, expected nothing", digest)
+	}
+}
+
+func TestChannelWelcomeMessage(t *testing.T) {
+	withConfig(t, &Params{
+		WelcomeMessage: "hi @{{username}}",
+		Teams: map[string]TeamOptions{
+			"eng": {Channels: map[string]ChannelOptions{
+				"builds": {Welcome: "read the pinned runbook", Digest: "CI results"},
+				"random": {Digest: "only in the DM"},
+			}},
+		},
+	})
+
+	tests := []struct {
+		channel  string
+		expected string
+	}{
+		{"builds", "read the pinned runbook"},
+		{"random", "hi @{{username}}"},
+		{"town-square", "hi @{{username}}"},
+	}
+	for _, test := range tests {
+		if message := ChannelWelcomeMessage("eng", test.channel); message != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.channel, message, test.expected)
+		}
+	}
+}
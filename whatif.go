@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mattermost/platform/model"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	WHATIF_SAMPLE_SIZE = 10
+)
+
+// HandleWhatifCommand previews how a proposed autoadd rule would change
+// where users are added, without adding anyone. The rule follows the
+// command on the next lines, optionally in a code block:
+//
+//	!whatif [username]
+//	pillarteam: [town-square, off-topic]
+//
+// Without a username the first users of the server are sampled.
+func HandleWhatifCommand(post *model.Post, args []string) {
+	lines := strings.SplitN(post.Message, "\n", 2)
+	if len(lines) < 2 {
+		ReplyToPost(post, "Usage: `"+CommandPrefix()+"whatif [username]` followed by the proposed autoadd rules on the next lines")
+		return
+	}
+
+	proposed, err := parseProposedRules(lines[1])
+	if err != nil {
+		ReplyToPost(post, "Could not parse the proposed rules: "+err.Error())
+		return
+	}
+
+	var users []*model.User
+	if header := strings.Fields(lines[0]); len(header) > 1 {
+		user, err := LookupUsername(header[1])
+		if err != nil {
+			ReplyToPost(post, "No user named "+header[1]+".")
+			return
+		}
+		users = []*model.User{user}
+	} else {
+		sample, resp := client.GetUsers(0, WHATIF_SAMPLE_SIZE, "")
+		if resp.Error != nil {
+			ReplyToPost(post, "Could not list users: "+resp.Error.Message)
+			return
+		}
+		users = sample
+	}
+
+	// The proposal goes through the same rulebased, domain, identity,
+	// no-email and guest rules as the running configuration
+	with_proposed := *Config()
+	with_proposed.Autoadd = proposed
+
+	msg := ""
+	for _, user := range users {
+		current := RulesFor(user)
+		if current == nil {
+			msg += "- @" + user.Username + ": skipped by the current rules\n"
+			continue
+		}
+
+		added, removed := diffDestinations(Destinations(current), Destinations(RulesWith(&with_proposed, user)))
+		if len(added) == 0 && len(removed) == 0 {
+			msg += "- @" + user.Username + ": no change\n"
+			continue
+		}
+
+		msg += "- @" + user.Username + ":"
+		if len(added) > 0 {
+			msg += " +" + strings.Join(added, ", +")
+		}
+		if len(removed) > 0 {
+			msg += " -" + strings.Join(removed, ", -")
+		}
+		msg += "\n"
+	}
+
+	ReplyToPost(post, "Compared with the rules each user gets now, nothing was changed:\n"+msg)
+}
+
+// parseProposedRules accepts either a bare rule map or one nested under
+// autoadd, as pasted from config.yaml.
+func parseProposedRules(snippet string) (map[string][]string, error) {
+	snippet = strings.TrimSpace(snippet)
+	snippet = strings.TrimPrefix(snippet, "```yaml")
+	snippet = strings.Trim(snippet, "`")
+
+	var wrapped struct {
+		Autoadd map[string][]string `yaml:"autoadd"`
+	}
+	if err := yaml.Unmarshal([]byte(snippet), &wrapped); err == nil && wrapped.Autoadd != nil {
+		return wrapped.Autoadd, nil
+	}
+
+	var rules map[string][]string
+	err := yaml.Unmarshal([]byte(snippet), &rules)
+
+	return rules, err
+}
+
+// Destinations lists the teams and team/channel pairs the rules add users
+// to, resolving all-except teams against their current channels.
+func Destinations(rules map[string][]string) []string {
+	var destinations []string
+	for team_name, rule := range rules {
+		destinations = append(destinations, team_name)
+
+		channels := rule
+		if team, resp := client.GetTeamByName(team_name, ""); resp.Error == nil {
+			if resolved, err := ChannelsToJoin(team, team_name, rule); err == nil {
+				channels = resolved
+			}
+		}
+
+		for _, channel := range channels {
+			if channel != "" {
+				destinations = append(destinations, team_name+"/"+channel)
+			}
+		}
+	}
+	sort.Strings(destinations)
+
+	return destinations
+}
+
+func diffDestinations(current []string, proposed []string) ([]string, []string) {
+	var added, removed []string
+	for _, destination := range proposed {
+		if !in_array(destination, current) {
+			added = append(added, destination)
+		}
+	}
+	for _, destination := range current {
+		if !in_array(destination, proposed) {
+			removed = append(removed, destination)
+		}
+	}
+
+	return added, removed
+}
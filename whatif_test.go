@@ -0,0 +1,34 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestHandleWhatifCommandAppliesRuleBased(t *testing.T) {
+	fake := setupAutoadd(t)
+	p := *Config()
+	p.Admins = []string{"jane"}
+	p.RuleBased = []RegexRule{{Match: "@example\\.com$", Team: "eng", Channels: []string{"random"}}}
+	withConfig(t, &p)
+
+	const prefix = "Compared with the rules each user gets now, nothing was changed:\n"
+	tests := []struct {
+		name     string
+		proposal string
+		reply    string
+	}{
+		{"the current rules", "eng: [builds, town-square]\npillarteam: [off-topic]", "- @jane: no change\n"},
+		{"a channel dropped", "eng: [builds]\npillarteam: [off-topic]", "- @jane: -eng/town-square\n"},
+		{"a team dropped", "autoadd:\n  pillarteam: [off-topic]", "- @jane: -eng/builds, -eng/town-square\n"},
+	}
+
+	for _, test := range tests {
+		replies := runCommand(t, fake, "jane", "!whatif jane\n"+test.proposal)
+		if len(replies) != 1 || replies[0] != prefix+test.reply {
+			t.Errorf("%s: replied %q, expected %q", test.name, replies, prefix+test.reply)
+		}
+	}
+}
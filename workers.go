@@ -0,0 +1,64 @@
+// Copyright (c) 2016 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/mattermost/platform/model"
+)
+
+// addSlots caps how many membership changes, adds to a team or channel and
+// mirrored removals, run at once across everything that makes them:
+// websocket events, backfills, sync and admin commands. A slot is held for
+// one API call, so the channel workers of a user each take their own. It
+// is nil when params.GlobalConcurrency is not set.
+var addSlots chan struct{}
+
+func SetupGlobalConcurrency() {
+	if Config().GlobalConcurrency > 0 {
+		addSlots = make(chan struct{}, Config().GlobalConcurrency)
+	}
+}
+
+// acquireAddSlot blocks until a membership change may be made
+func acquireAddSlot() {
+	if addSlots != nil {
+		addSlots <- struct{}{}
+	}
+}
+
+func releaseAddSlot() {
+	if addSlots != nil {
+		<-addSlots
+	}
+}
+
+// dispatch runs fn off the websocket listener, so that work waiting for a
+// slot doesn't hold up the events behind it, such as !cancel. A panic in fn
+// is logged and dropped like one in the listener.
+func dispatch(name string, fn func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				CountError()
+				logger.Error("Dropped work that panicked", "work", name,
+					"panic", r, "stack", string(debug.Stack()))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+func HandleWorkersCommand(post *model.Post, args []string) {
+	if addSlots == nil {
+		ReplyToPost(post, fmt.Sprintf("No global concurrency limit, %d add(s) in progress.", InFlightAdds()))
+		return
+	}
+
+	ReplyToPost(post, fmt.Sprintf("%d of %d global add slots in use, %d add(s) in progress or waiting.",
+		len(addSlots), cap(addSlots), InFlightAdds()))
+}